@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ynabDateLayout is the mm/dd/yyyy date format used by Register.csv exports.
+const ynabDateLayout = "1/2/2006"
+
+// parseYNABDate parses a date from a register export.
+func parseYNABDate(s string) (time.Time, error) {
+	return time.Parse(ynabDateLayout, strings.TrimSpace(s))
+}
+
+// parseAmount parses an amount such as "$1,234.56" or "-€4.10" into
+// milliunits, the same fixed-point representation the YNAB API uses.
+// An empty string parses as zero.
+func parseAmount(s string) (int64, error) {
+	neg := false
+	var digits strings.Builder
+	for _, r := range strings.TrimSpace(s) {
+		// Currency symbols, codes and separators carry no value
+		switch {
+		case r >= '0' && r <= '9', r == '.':
+			digits.WriteRune(r)
+		case r == '-', r == '(':
+			neg = true
+		}
+	}
+	if digits.Len() == 0 {
+		return 0, nil
+	}
+
+	whole, frac, _ := strings.Cut(digits.String(), ".")
+	if len(frac) > 3 {
+		frac = frac[:3]
+	}
+	frac += strings.Repeat("0", 3-len(frac))
+	if whole == "" {
+		whole = "0"
+	}
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// amountCommodity returns the currency symbol or code of an amount such as
+// "$1.00" or "1.00 EUR".
+func amountCommodity(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || strings.ContainsRune(".,-()", r) {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// formatAmount renders milliunits in the given commodity. Symbols such as "$"
+// are written before the number and codes such as "EUR" after it, the way
+// Ledger prints them.
+func formatAmount(milli int64, commodity string) string {
+	sign := ""
+	if milli < 0 {
+		sign, milli = "-", -milli
+	}
+	num := fmt.Sprintf("%s%d.%02d", sign, milli/1000, milli%1000/10)
+	if milli%10 != 0 {
+		num = fmt.Sprintf("%s%d.%03d", sign, milli/1000, milli%1000)
+	}
+
+	switch {
+	case commodity == "":
+		return num
+	case isCommodityCode(commodity):
+		return num + " " + commodity
+	default:
+		return commodity + num
+	}
+}
+
+// isCommodityCode reports whether a commodity is a code made of letters,
+// like "EUR", rather than a symbol like "$".
+func isCommodityCode(commodity string) bool {
+	for _, r := range commodity {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return len(commodity) > 1
+}
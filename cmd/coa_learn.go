@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// learnedMappings holds, for each YNAB account and category, how often the
+// rows of an export were posted to each Ledger account in an existing
+// journal.
+type learnedMappings struct {
+	votes map[coaName]map[string]int
+
+	rows    int // rows of the export
+	matched int // rows matched to a journal transaction
+}
+
+// learnedAccount is the Ledger account a name was most often posted to.
+type learnedAccount struct {
+	Account string
+	Votes   int
+	Total   int // matched rows of the name
+}
+
+func (l learnedAccount) note() string {
+	rows := "1 matched transaction"
+	if l.Total != 1 {
+		rows = fmt.Sprintf("%d matched transactions", l.Total)
+	}
+	return fmt.Sprintf("learned: %d%% of %s", l.Votes*100/l.Total, rows)
+}
+
+// ledgerKey indexes journal transactions by date and absolute amount.
+type ledgerKey struct {
+	date   time.Time
+	amount int64
+}
+
+// learnMappings matches the rows of a register export to the transactions of
+// a journal by date and amount, using the payee to choose between several
+// candidates, and counts which Ledger accounts the two sides of each matched
+// row were posted to. The side with the row's amount is its account, the
+// side with the opposite amount its category, or the other account of a
+// transfer.
+func learnMappings(r io.Reader, txns []ledgerTransaction) (*learnedMappings, error) {
+	index := make(map[ledgerKey][]*ledgerTransaction)
+	for i := range txns {
+		txn := &txns[i]
+		seen := make(map[int64]bool)
+		for _, p := range txn.Postings {
+			amount := abs(p.Amount)
+			if amount != 0 && !p.Virtual && !seen[amount] {
+				seen[amount] = true
+				key := ledgerKey{txn.Date, amount}
+				index[key] = append(index[key], txn)
+			}
+		}
+	}
+
+	rows, err := newRegisterReader(r)
+	if err != nil {
+		return nil, err
+	}
+	learned := &learnedMappings{votes: make(map[coaName]map[string]int)}
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+		learned.rows++
+
+		date, err := parseYNABDate(row.Date)
+		if err != nil {
+			continue
+		}
+		inflow, _ := parseAmount(row.Inflow)
+		outflow, _ := parseAmount(row.Outflow)
+		amount := inflow - outflow
+		if amount == 0 {
+			continue
+		}
+		txn := pickTransaction(index[ledgerKey{date, abs(amount)}], row.Payee)
+		if txn == nil {
+			continue
+		}
+		learned.matched++
+
+		other := coaName{"categories", row.Category}
+		if name, ok := transferAccount(row.Payee); ok {
+			other = coaName{"accounts", name}
+		}
+		if p, ok := txn.posting(amount); ok {
+			learned.vote(coaName{"accounts", row.Account}, p.Account)
+		}
+		if p, ok := txn.posting(-amount); ok && other.name != "" {
+			learned.vote(other, p.Account)
+		}
+	}
+	return learned, nil
+}
+
+// posting returns the first real posting of a transaction with an amount.
+func (t *ledgerTransaction) posting(amount int64) (ledgerPosting, bool) {
+	for _, p := range t.Postings {
+		if p.Amount == amount && !p.Virtual {
+			return p, true
+		}
+	}
+	return ledgerPosting{}, false
+}
+
+// pickTransaction chooses the journal transaction a row matches among those
+// with its date and amount: the only one, or else the only one whose payee
+// looks like the row's.
+func pickTransaction(candidates []*ledgerTransaction, payee string) *ledgerTransaction {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	var match *ledgerTransaction
+	for _, txn := range candidates {
+		if similarPayee(txn.Payee, payee) {
+			if match != nil {
+				return nil
+			}
+			match = txn
+		}
+	}
+	return match
+}
+
+// minPayeeLength is the fewest letters and digits a payee needs to be
+// matched by similarPayee, so that names like "A" do not match everything.
+const minPayeeLength = 3
+
+// similarPayee reports whether two payees name the same party, ignoring
+// case, punctuation and extra words on either side. Whole words are
+// compared, so "Shell" matches "Shell Oil 123" but not "Shellfish Co".
+func similarPayee(a, b string) bool {
+	wa, wb := payeeWords(a), payeeWords(b)
+	if len(wa) > len(wb) {
+		wa, wb = wb, wa
+	}
+	if len(wa) == 0 || len(strings.Join(wa, "")) < minPayeeLength {
+		return false
+	}
+	for i := 0; i+len(wa) <= len(wb); i++ {
+		if slices.Equal(wa, wb[i:i+len(wa)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// payeeWords splits a payee into lower-case words without punctuation.
+func payeeWords(payee string) []string {
+	return strings.FieldsFunc(ledgerSegment(strings.ToLower(payee), "kebab"), func(r rune) bool {
+		return r == '-'
+	})
+}
+
+func (l *learnedMappings) vote(name coaName, account string) {
+	if l.votes[name] == nil {
+		l.votes[name] = make(map[string]int)
+	}
+	l.votes[name][account]++
+}
+
+// best returns the Ledger account a name was posted to most often, the
+// alphabetically first on a tie.
+func (l *learnedMappings) best(name coaName) (learnedAccount, bool) {
+	if l == nil {
+		return learnedAccount{}, false
+	}
+	votes := l.votes[name]
+	accounts := make([]string, 0, len(votes))
+	total := 0
+	for account, n := range votes {
+		accounts = append(accounts, account)
+		total += n
+	}
+	if total == 0 {
+		return learnedAccount{}, false
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if votes[accounts[i]] != votes[accounts[j]] {
+			return votes[accounts[i]] > votes[accounts[j]]
+		}
+		return accounts[i] < accounts[j]
+	})
+	return learnedAccount{Account: accounts[0], Votes: votes[accounts[0]], Total: total}, true
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// learnFromJournal reads a Ledger journal and learns from it with the rows
+// of a register export that has already been read once.
+func learnFromJournal(register io.ReadSeeker, journalFile string) (*learnedMappings, error) {
+	journal, err := os.Open(journalFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open journal: %w", err)
+	}
+	defer journal.Close()
+
+	txns, err := readLedgerJournal(journal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", journalFile, err)
+	}
+	if _, err := register.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return learnMappings(register, txns)
+}
@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeCOA adds the accounts and categories of a register that an existing
+// mapping file does not cover yet, by key, alias or category group, keeping
+// everything already in the file: its entries, comments, spacing and order. New keys go before the
+// section's "*" catch-all and are marked with a "# new" comment. It returns
+// the merged file and a report of what was added and of the keys that the
+// register no longer uses.
+func mergeCOA(existing []byte, suggest *coaSuggester) ([]byte, string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(existing, &doc); err != nil {
+		return nil, "", err
+	}
+	root, err := mappingRoot(&doc)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		report  strings.Builder
+		inserts []sectionInsert
+	)
+	sections := []struct {
+		name    string
+		names   []string
+		suggest func(string) (string, string)
+	}{
+		{"accounts", suggest.scan.ordered("accounts", suggest.opts.Sort), suggest.account},
+		{"categories", suggest.scan.ordered("categories", suggest.opts.Sort), suggest.category},
+	}
+	for _, section := range sections {
+		node := sectionValue(root, section.name)
+		if node != nil && node.Kind != yaml.MappingNode && node.Tag != "!!null" {
+			return nil, "", fmt.Errorf("line %d: %s is not a mapping", node.Line, section.name)
+		}
+
+		// Category group keys stay in use while any of their categories is
+		inUse := make(map[string]bool, len(section.names))
+		for _, name := range section.names {
+			inUse[name] = true
+			if group, _, ok := splitCategory(name); ok && section.name == "categories" {
+				inUse[group] = true
+				inUse[group+": *"] = true
+			}
+		}
+		covered := make(map[string]bool)
+		if node != nil {
+			covered = coveredNames(node)
+		}
+
+		insert := sectionInsert{section: section.name}
+		added := 0
+		for _, name := range section.names {
+			if covered[name] {
+				continue
+			}
+			// A category its group key maps is covered too; an entry of its
+			// own would override the group on the next conversion
+			if group, _, ok := splitCategory(name); ok && section.name == "categories" && (covered[group] || covered[group+": *"]) {
+				continue
+			}
+			target, note := section.suggest(name)
+			comment := "# new"
+			if note != "" {
+				comment += "; " + note
+			}
+			insert.lines = append(insert.lines,
+				"# "+suggest.usageComment(section.name, name),
+				fmt.Sprintf("%s:    %s  %s", yamlQuote(name), yamlScalar(target), comment))
+			added++
+		}
+		if added > 0 {
+			inserts = append(inserts, insert)
+		}
+
+		var stale []string
+		if node != nil {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				if !keyInUse(key.Value, node.Content[i+1], inUse) {
+					stale = append(stale, fmt.Sprintf("  %s[%q] (line %d) is no longer in the export\n", section.name, key.Value, key.Line))
+				}
+			}
+		}
+		fmt.Fprintf(&report, "%s: %d added, %d no longer in the export\n", section.name, added, len(stale))
+		report.WriteString(strings.Join(stale, ""))
+	}
+
+	merged, err := insertEntries(existing, root, inserts)
+	if err != nil {
+		return nil, "", err
+	}
+	return merged, report.String(), nil
+}
+
+// mappingRoot returns the top-level mapping of a parsed mapping file, or an
+// empty one for an empty file.
+func mappingRoot(doc *yaml.Node) (*yaml.Node, error) {
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: mapping file is not a mapping", root.Line)
+	}
+	return root, nil
+}
+
+// sectionValue returns the value of a top-level key, or nil.
+func sectionValue(root *yaml.Node, name string) *yaml.Node {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == name {
+			return root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sectionInsert is text to add to a section of a mapping file, one entry
+// line or comment per element, without indentation.
+type sectionInsert struct {
+	section string
+	lines   []string
+}
+
+// insertEntries adds lines to sections of a mapping file as text, leaving
+// every other byte of it alone. The lines of a section go before its "*"
+// catch-all and the comments right above it, or after its last entry when
+// it has none, indented like its keys. Sections the file lacks are
+// appended to it. root is the parsed file, for the positions of its keys.
+func insertEntries(data []byte, root *yaml.Node, inserts []sectionInsert) ([]byte, error) {
+	if len(inserts) == 0 {
+		return data, nil
+	}
+	if root.Style == yaml.FlowStyle {
+		return nil, fmt.Errorf("line %d: mapping file is written in flow style", root.Line)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += "\n"
+	}
+	isComment := func(i int) bool {
+		return strings.HasPrefix(strings.TrimSpace(lines[i]), "#")
+	}
+	isBlank := func(i int) bool {
+		return strings.TrimSpace(lines[i]) == ""
+	}
+
+	text := make(map[int]string) // by index of the line the text goes before
+	var appended strings.Builder
+	for _, insert := range inserts {
+		var keyNode, node *yaml.Node
+		next := len(lines) // index of the line of the next top-level key
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if keyNode != nil {
+				next = root.Content[i].Line - 1
+				break
+			}
+			if root.Content[i].Value == insert.section {
+				keyNode, node = root.Content[i], root.Content[i+1]
+			}
+		}
+
+		var (
+			at     int
+			indent = "  "
+		)
+		switch {
+		case keyNode == nil:
+			if len(lines) > 0 || appended.Len() > 0 {
+				appended.WriteString("\n")
+			}
+			appended.WriteString(insert.section + ":\n")
+			for _, l := range insert.lines {
+				appended.WriteString(indent + l + "\n")
+			}
+			continue
+		case node.Tag == "!!null" && node.Value == "":
+			at = keyNode.Line
+		case node.Kind != yaml.MappingNode || node.Style == yaml.FlowStyle:
+			return nil, fmt.Errorf("line %d: %s is not a block mapping", node.Line, insert.section)
+		default:
+			indent = strings.Repeat(" ", node.Content[0].Column-1)
+			at = -1
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == "*" {
+					at = node.Content[i].Line - 1
+					break
+				}
+			}
+			if at >= 0 {
+				// Keep the comments right above the catch-all with it
+				for at > keyNode.Line && isComment(at-1) {
+					at--
+				}
+			} else {
+				// Go after the last entry, leaving the blank lines and
+				// comments ahead of the next section where they are
+				at = next
+				for at > keyNode.Line && (isBlank(at-1) || isComment(at-1)) {
+					at--
+				}
+			}
+		}
+		var sb strings.Builder
+		for _, l := range insert.lines {
+			sb.WriteString(indent + l + "\n")
+		}
+		text[at] += sb.String()
+	}
+
+	var out strings.Builder
+	for i := 0; i <= len(lines); i++ {
+		out.WriteString(text[i])
+		if i < len(lines) {
+			out.WriteString(lines[i])
+		}
+	}
+	out.WriteString(appended.String())
+	return []byte(out.String()), nil
+}
+
+// yamlQuote writes a string as a double-quoted YAML scalar. Only
+// backslashes, double quotes and control characters are escaped; other
+// characters, emoji included, are written as they are so that the key stays
+// readable. Invalid UTF-8 becomes U+FFFD.
+func yamlQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '"':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r < 0x20 || r >= 0x7f && r <= 0x9f:
+			fmt.Fprintf(&sb, `\x%02x`, r)
+		case r == 0x2028 || r == 0x2029 || r == 0xfeff || r == 0xfffe || r == 0xffff:
+			// Line separators, the byte order mark and non-characters
+			fmt.Fprintf(&sb, `\u%04x`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// yamlScalar writes a string as a YAML scalar, quoted only when it has to be.
+func yamlScalar(s string) string {
+	if !utf8.ValidString(s) {
+		return yamlQuote(s)
+	}
+	out := encodeScalar(&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s})
+	if strings.HasPrefix(out, `"`) {
+		// The encoder escapes characters outside the BMP in double quotes
+		return yamlQuote(s)
+	}
+	return out
+}
+
+func encodeScalar(node *yaml.Node) string {
+	out, err := yaml.Marshal(node)
+	if err != nil {
+		// Marshalling a string scalar does not fail
+		panic(err)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+// coveredNames lists the keys of a section and the aliases of its entries.
+func coveredNames(section *yaml.Node) map[string]bool {
+	covered := make(map[string]bool)
+	for i := 0; i+1 < len(section.Content); i += 2 {
+		covered[section.Content[i].Value] = true
+		for _, alias := range entryAliases(section.Content[i+1]) {
+			covered[alias] = true
+		}
+	}
+	return covered
+}
+
+// entryAliases returns the aliases listed by the entries of a mapping value.
+func entryAliases(value *yaml.Node) []string {
+	entries := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		entries = value.Content
+	}
+	var aliases []string
+	for _, e := range entries {
+		if e.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(e.Content); i += 2 {
+			if e.Content[i].Value == "aliases" {
+				for _, a := range e.Content[i+1].Content {
+					aliases = append(aliases, a.Value)
+				}
+			}
+		}
+	}
+	return aliases
+}
+
+// keyInUse reports whether a key, one of its aliases or the catch-all is
+// among the names in use.
+func keyInUse(key string, value *yaml.Node, inUse map[string]bool) bool {
+	if key == "*" || inUse[key] {
+		return true
+	}
+	for _, alias := range entryAliases(value) {
+		if inUse[alias] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeCOA(t *testing.T) {
+	existing := []byte(`# My chart of accounts
+accounts:
+  "Checking":    Assets:Bank:Chase   # renamed by hand
+  "Old Card":    Liabilities:OldCard
+  "Brokerage":
+    account: Assets:Invest
+    aliases: ["Brokerage (old)"]
+  "*":    Assets:Unknown
+
+categories:
+  # bills
+  "Bills: Electric":    Expenses:Utilities:Electric
+  "Fun": Expenses:Fun:*
+  "Food: *": Expenses:Food
+`)
+
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Savings","","01/03/2021","Power Co","Bills: Electric","Bills","Electric","",$0.00,$50.00,"Cleared"
+"Brokerage (old)","","01/04/2021","Fee","Bills: Electric","Bills","Electric","",$0.00,$1.00,"Cleared"
+"Checking","","01/05/2021","Airline","Travel: Flights","Travel","Flights","",$90.00,$0.00,"Cleared"`
+	scan, err := scanRegister(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	suggest, err := newCOASuggester(defaultCOAOptions(), scan)
+	if err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+
+	merged, report, err := mergeCOA(existing, suggest)
+	if err != nil {
+		t.Fatalf("mergeCOA() error = %v", err)
+	}
+
+	// The file is kept byte for byte around the added lines, and "Food:
+	// Groceries" is left to its group key
+	expected := `# My chart of accounts
+accounts:
+  "Checking":    Assets:Bank:Chase   # renamed by hand
+  "Old Card":    Liabilities:OldCard
+  "Brokerage":
+    account: Assets:Invest
+    aliases: ["Brokerage (old)"]
+  # 1 transaction, outflow $0.00, inflow $50.00, 2021-01-03 to 2021-01-03
+  "Savings":    Assets:Bank:Savings  # new
+  "*":    Assets:Unknown
+
+categories:
+  # bills
+  "Bills: Electric":    Expenses:Utilities:Electric
+  "Fun": Expenses:Fun:*
+  "Food: *": Expenses:Food
+  # 1 transaction, outflow $90.00, inflow $0.00, 2021-01-05 to 2021-01-05
+  "Travel: Flights":    Expenses:Travel:Flights  # new
+`
+	if string(merged) != expected {
+		t.Errorf("mergeCOA() =\n%s\nwant\n%s", merged, expected)
+	}
+
+	expectedReport := "accounts: 1 added, 1 no longer in the export\n" +
+		"  accounts[\"Old Card\"] (line 4) is no longer in the export\n" +
+		"categories: 1 added, 1 no longer in the export\n" +
+		"  categories[\"Fun\"] (line 13) is no longer in the export\n"
+	if report != expectedReport {
+		t.Errorf("mergeCOA() report = %q, want %q", report, expectedReport)
+	}
+
+	if _, err := parseMapping(merged); err != nil {
+		t.Errorf("merged mapping does not load: %v", err)
+	}
+
+	// A plain group key covers its categories as well
+	csv += "\n" + `"Checking","","01/06/2021","Cinema","Fun: Movies","Fun","Movies","",$12.00,$0.00,"Cleared"`
+	if scan, err = scanRegister(strings.NewReader(csv)); err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	if suggest, err = newCOASuggester(defaultCOAOptions(), scan); err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+	if merged, report, err = mergeCOA(existing, suggest); err != nil {
+		t.Fatalf("mergeCOA() error = %v", err)
+	}
+	if string(merged) != expected {
+		t.Errorf("mergeCOA() with Fun: Movies =\n%s\nwant\n%s", merged, expected)
+	}
+	if !strings.Contains(report, "categories: 1 added, 0 no longer in the export\n") {
+		t.Errorf("mergeCOA() report = %q", report)
+	}
+}
+
+func TestInsertEntries(t *testing.T) {
+	tests := []struct {
+		name, data string
+		inserts    []sectionInsert
+		want       string
+	}{
+		{
+			name:    "before the comments above the catch-all",
+			data:    "accounts:\n    Checking: Assets:Bank   # main\n\n    # everything else\n    \"*\": Assets:Unknown\nrules:\n  - {payee: \"x*\", target: 'Expenses:X'}\n",
+			inserts: []sectionInsert{{"accounts", []string{`"Savings": Assets:Savings`}}},
+			want:    "accounts:\n    Checking: Assets:Bank   # main\n\n    \"Savings\": Assets:Savings\n    # everything else\n    \"*\": Assets:Unknown\nrules:\n  - {payee: \"x*\", target: 'Expenses:X'}\n",
+		},
+		{
+			name:    "after the last entry without a catch-all",
+			data:    "categories:\n  Food: Expenses:Food\n\n# payee rules\npayees:\n  - {match: Shop, name: Shop}",
+			inserts: []sectionInsert{{"categories", []string{"# new", `"Fun": Expenses:Fun`}}},
+			want:    "categories:\n  Food: Expenses:Food\n  # new\n  \"Fun\": Expenses:Fun\n\n# payee rules\npayees:\n  - {match: Shop, name: Shop}\n",
+		},
+		{
+			name: "empty and missing sections",
+			data: "accounts:\ncategories: # none yet\n",
+			inserts: []sectionInsert{
+				{"accounts", []string{`"Checking": Assets:Bank`}},
+				{"categories", []string{`"Food": Expenses:Food`}},
+				{"exclude", []string{`- payee: Test`}},
+			},
+			want: "accounts:\n  \"Checking\": Assets:Bank\ncategories: # none yet\n  \"Food\": Expenses:Food\n\nexclude:\n  - payee: Test\n",
+		},
+	}
+	for _, tt := range tests {
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(tt.data), &doc); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		root, err := mappingRoot(&doc)
+		if err != nil {
+			t.Fatalf("%s: mappingRoot() error = %v", tt.name, err)
+		}
+		got, err := insertEntries([]byte(tt.data), root, tt.inserts)
+		if err != nil {
+			t.Fatalf("%s: insertEntries() error = %v", tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: insertEntries() =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+
+	if got := yamlQuote(`Kids "Fun" \ Games`); got != `"Kids \"Fun\" \\ Games"` {
+		t.Errorf("yamlQuote() = %s", got)
+	}
+	if got := yamlQuote("Fun 🎉: Coffee\t\x01"); got != `"Fun 🎉: Coffee\t\x01"` {
+		t.Errorf("yamlQuote() = %s", got)
+	}
+	if got := yamlScalar("Expenses:Fun 🎉"); got != `"Expenses:Fun 🎉"` {
+		t.Errorf("yamlScalar() = %s", got)
+	}
+	if got := yamlScalar("Expenses:Fun # 2"); got != `'Expenses:Fun # 2'` {
+		t.Errorf("yamlScalar() = %s", got)
+	}
+}
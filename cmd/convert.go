@@ -2,53 +2,15 @@ package cmd
 
 import (
 	"bufio"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-
-	"gopkg.in/yaml.v3"
 )
 
-type Mapping struct {
-	Accounts   map[string]string `yaml:"accounts"`
-	Categories map[string]string `yaml:"categories"`
-}
-
-func loadMapping(path string) (*Mapping, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var m Mapping
-	if err := yaml.Unmarshal(data, &m); err != nil {
-		return nil, err
-	}
-	return &m, nil
-}
-
-func mapAccount(mapping *Mapping, ynabAccount string) string {
-	if acct, ok := mapping.Accounts[ynabAccount]; ok {
-		return acct
-	}
-	if acct, ok := mapping.Accounts["*"]; ok {
-		return acct
-	}
-	return "Assets:Unknown"
-}
-
-func mapCategory(mapping *Mapping, ynabCategory string) string {
-	if cat, ok := mapping.Categories[ynabCategory]; ok {
-		return cat
-	}
-	if cat, ok := mapping.Categories["*"]; ok {
-		return cat
-	}
-	return "Expenses:Unknown"
-}
-
 func convertFile(inputFile, outputFile string) error {
 	// Open the input file
 	file, err := os.Open(inputFile)
@@ -67,147 +29,325 @@ func convertFile(inputFile, outputFile string) error {
 	fmt.Println("File preview:")
 	printFilePreview(inputFile)
 
-	// Process the CSV and get the ledger output
-	output, err := process(file, mapping)
+	out, destination, err := openJournal(outputFile, convertOpts)
 	if err != nil {
-		return fmt.Errorf("error processing file: %w", err)
+		return fmt.Errorf("error writing to output file: %w", err)
 	}
 
-	// Write to output file
-	err = os.WriteFile(outputFile, []byte(output), 0644)
+	// Stream the CSV straight into the output file(s)
+	excluded, err := convertTo(file, out, mapping, convertOpts)
 	if err != nil {
+		out.Close()
+		return fmt.Errorf("error processing file: %w", err)
+	}
+	if err := out.Close(); err != nil {
 		return fmt.Errorf("error writing to output file: %w", err)
 	}
 
-	fmt.Printf("Successfully converted to %s\n", outputFile)
+	excluded.print(os.Stdout)
+	fmt.Printf("Successfully converted to %s\n", destination)
 	return nil
 }
 
-func process(r io.Reader, mapping *Mapping) (string, error) {
-	// Read the entire file content
-	content, err := io.ReadAll(r)
-	if err != nil {
-		return "", fmt.Errorf("failed to read file content: %w", err)
+// openJournal creates the journal writer for the output options and returns
+// it with the path of the main file written.
+func openJournal(outputFile string, opts convertOptions) (journalWriter, string, error) {
+	switch {
+	case opts.OutputDir != "" && opts.SplitBy != "":
+		return nil, "", fmt.Errorf("--output-dir and --split-by cannot be combined")
+	case opts.OutputDir != "" && opts.CloseYears:
+		return nil, "", fmt.Errorf("--output-dir and --close-years cannot be combined")
+	case opts.OutputDir != "":
+		out, err := newAccountWriter(opts.OutputDir)
+		return out, filepath.Join(opts.OutputDir, "index.ledger"), err
+	case opts.SplitBy != "":
+		out, err := newPeriodWriter(outputFile, opts)
+		return out, outputFile, err
+	case opts.CloseYears:
+		return nil, "", fmt.Errorf("--close-years needs --split-by")
+	default:
+		out, err := createJournalFile(outputFile)
+		return out, outputFile, err
 	}
+}
 
-	// Remove BOM if present
-	content = removeBOM(content)
+// convertOptions controls how a register export is turned into a journal.
+type convertOptions struct {
+	Sort       string // date, date-desc or source
+	TieBreak   string // row, account or amount
+	Since      string // yyyy-mm-dd, inclusive
+	Until      string // yyyy-mm-dd, inclusive
+	Accounts   []string
+	Categories []string
+
+	// OpeningBalances summarises the rows before Since into a single
+	// opening-balance transaction against OpeningAccount.
+	OpeningBalances bool
+	OpeningAccount  string
+
+	// SplitBy writes one file per year or month; CloseYears adds year-end
+	// closing entries into RetainedEarnings.
+	SplitBy          string
+	CloseYears       bool
+	RetainedEarnings string
+
+	// OutputDir writes one file per mapped account plus an index.ledger.
+	OutputDir string
+
+	// AnnotateMapping adds a comment to every posting naming the mapping
+	// entry or rule that produced its account.
+	AnnotateMapping bool
+
+	// DeclarePayees starts the journal with a payee directive for every
+	// canonical name produced by the mapping's payee rules.
+	DeclarePayees bool
+}
 
-	// Convert to string and normalize line endings
-	fileContent := strings.ReplaceAll(string(content), "\r\n", "\n")
+func defaultConvertOptions() convertOptions {
+	return convertOptions{
+		Sort:             "date",
+		TieBreak:         "row",
+		OpeningBalances:  true,
+		OpeningAccount:   "Equity:Opening Balances",
+		RetainedEarnings: "Equity:Retained Earnings",
+	}
+}
+
+// process converts a whole register export with the default options and
+// returns the journal as a string.
+func process(r io.Reader, mapping *Mapping) (string, error) {
+	var sb strings.Builder
+	if err := convert(r, &sb, mapping, defaultConvertOptions()); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
 
-	// Try to detect the delimiter
-	delimiter := detectDelimiter(fileContent)
-	fmt.Printf("Detected delimiter: %q\n", delimiter)
+// convert streams a register export from r and writes the Ledger journal to w.
+func convert(r io.Reader, w io.Writer, mapping *Mapping, opts convertOptions) error {
+	out := newJournalStream(w)
+	if _, err := convertTo(r, out, mapping, opts); err != nil {
+		return err
+	}
+	return out.Close()
+}
 
-	// Try a simple fix for the specific error: bare " in non-quoted-field
-	fileContent = fixBareQuotes(fileContent, delimiter)
+// convertTo streams a register export from r into a journal writer. Rows are
+// read one at a time and entries are ordered by an entrySorter, so memory use
+// stays bounded regardless of the size of the export. Rows excluded by the
+// mapping are dropped, and those within the date range are counted in the
+// returned summary.
+func convertTo(r io.Reader, out journalWriter, mapping *Mapping, opts convertOptions) (*exclusionSummary, error) {
+	excluded := &exclusionSummary{}
 
-	// Create a new reader from the normalized content
-	reader := csv.NewReader(strings.NewReader(fileContent))
+	less, err := entryOrder(opts.Sort, opts.TieBreak)
+	if err != nil {
+		return excluded, err
+	}
 
-	// Configure the CSV reader to be more flexible
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1 // Allow variable number of fields
-	reader.TrimLeadingSpace = true
-	reader.Comma = rune(delimiter[0]) // Set the detected delimiter
+	filter, err := newRowFilter(opts)
+	if err != nil {
+		return excluded, err
+	}
 
-	// Read and skip the header row
-	headers, err := reader.Read()
+	rows, err := newRegisterReader(r)
 	if err != nil {
-		// If standard parsing fails, try the fallback method
-		fmt.Println("Standard CSV parsing failed, trying fallback method...")
-		return processFallback(fileContent, delimiter, mapping)
+		return excluded, err
 	}
 
-	// Find the column indices for the fields we need
-	accountIdx := findColumnIndex(headers, "Account")
-	dateIdx := findColumnIndex(headers, "Date")
-	payeeIdx := findColumnIndex(headers, "Payee")
-	categoryGroupCategoryIdx := findColumnIndex(headers, "Category Group/Category")
-	memoIdx := findColumnIndex(headers, "Memo")
-	outflowIdx := findColumnIndex(headers, "Outflow")
-	inflowIdx := findColumnIndex(headers, "Inflow")
+	sorter := newEntrySorter(less, sortBufferSize)
+	defer sorter.Close()
 
-	if accountIdx == -1 || dateIdx == -1 || payeeIdx == -1 ||
-		categoryGroupCategoryIdx == -1 || memoIdx == -1 ||
-		outflowIdx == -1 || inflowIdx == -1 {
-		return "", fmt.Errorf("required column not found in CSV. Headers found: %v", headers)
+	var opening *openingBalances
+	if opts.OpeningBalances && !filter.since.IsZero() {
+		opening = newOpeningBalances()
 	}
 
-	entries := []string{}
+	payees := make(map[string]bool)
 
 	// Process each row
-	for {
-		row, err := reader.Read()
+	for seq := 0; ; seq++ {
+		row, err := rows.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return "", fmt.Errorf("error reading row: %w", err)
+			return excluded, fmt.Errorf("error reading row: %w", err)
 		}
 
-		ledgerAccount := mapAccount(mapping, row[accountIdx])
-		ledgerCategory := mapCategory(mapping, row[categoryGroupCategoryIdx])
+		date, _ := parseYNABDate(row.Date)
+		if !filter.matchFields(row) {
+			continue
+		}
+		if !filter.matchDate(date) {
+			// Excluded rows stay out of the opening balances too, but only
+			// rows in the date range count towards the summary
+			if opening != nil && !date.IsZero() && date.Before(filter.since) {
+				if _, ok := mapping.excluded(row); !ok {
+					opening.add(row, mapping)
+				}
+			}
+			continue
+		}
+		if match, ok := mapping.excluded(row); ok {
+			excluded.add(row, match)
+			continue
+		}
+
+		ledgerAccount := resolveAccount(mapping, row)
+		ledgerCategory := resolveCategory(mapping, row)
+
+		e, ok := ledgerEntry(row, ledgerAccount, ledgerCategory, mapping, opts.AnnotateMapping)
+		if !ok {
+			continue
+		}
+		e.Seq = seq
+		if opts.DeclarePayees && e.Payee != row.Payee {
+			payees[e.Payee] = true
+		}
+		if err := sorter.Add(e); err != nil {
+			return excluded, err
+		}
+	}
 
-		entry := ledgerEntry(row, accountIdx, dateIdx, payeeIdx, categoryGroupCategoryIdx, memoIdx, outflowIdx, inflowIdx, ledgerAccount, ledgerCategory, mapping)
-		if entry != "" {
-			entries = append(entries, entry)
+	if opening != nil {
+		if e, ok := opening.entry(filter.since, opts.OpeningAccount); ok {
+			if err := sorter.Add(e); err != nil {
+				return excluded, err
+			}
 		}
 	}
 
-	// Reverse the entries as the original Ruby code does
-	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
-		entries[i], entries[j] = entries[j], entries[i]
+	if len(payees) > 0 {
+		names := make([]string, 0, len(payees))
+		for name := range payees {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := out.WriteDirective("payee " + name); err != nil {
+				return excluded, err
+			}
+		}
 	}
 
-	return strings.Join(entries, "\n"), nil
+	return excluded, sorter.Drain(out.WriteEntry)
 }
 
-func ledgerEntry(row []string, accountIdx, dateIdx, payeeIdx, categoryGroupCategoryIdx, memoIdx, outflowIdx, inflowIdx int, ledgerAccount, ledgerCategory string, mapping *Mapping) string {
-	inflow := blankIfZero(row[inflowIdx])
-	outflow := blankIfZero(row[outflowIdx])
+// ledgerEntry renders a register row as a journal entry. It reports false for
+// rows that produce no entry: zero amounts, malformed dates and the inflow
+// side of transfers, which are rendered from their outflow side instead. Tags
+// and metadata of the mapping entries are written under their postings, and
+// an entry's payee or commodity replaces the row's, the category side taking
+// precedence. With annotate set, each posting is followed by a comment naming
+// the mapping entry or rule that produced its account.
+func ledgerEntry(row ynabRow, account, category mappingMatch, mapping *Mapping, annotate bool) (journalEntry, bool) {
+	inflow := blankIfZero(row.Inflow)
+	outflow := blankIfZero(row.Outflow)
 
 	if inflow == "" && outflow == "" {
-		return ""
+		return journalEntry{}, false
 	}
 
 	// Parse the date from mm/dd/yyyy to yyyy/mm/dd
-	dateParts := strings.Split(row[dateIdx], "/")
+	dateParts := strings.Split(row.Date, "/")
 	if len(dateParts) != 3 {
-		return ""
+		return journalEntry{}, false
 	}
 	month, day, year := dateParts[0], dateParts[1], dateParts[2]
 
-	var source string
-	if strings.Contains(row[payeeIdx], "Transfer :") {
+	var source mappingMatch
+	if transferTo, ok := transferAccount(row.Payee); ok {
 		if outflow == "" {
-			return ""
+			return journalEntry{}, false
 		}
-		parts := strings.Split(row[payeeIdx], ":")
-		transferAccount := strings.TrimSpace(parts[len(parts)-1])
-		source = mapAccount(mapping, transferAccount) // Map the transfer account name
+		source = resolveAccount(mapping, row.withAccount(transferTo)) // Map the transfer account name
 	} else {
-		source = ledgerCategory
+		source = category
 	}
 
-	if source == "" {
-		return ""
+	if source.Account == "" {
+		return journalEntry{}, false
+	}
+
+	sourceNote, accountNote := "", ""
+	if source.Entry != nil {
+		sourceNote = source.Entry.comments()
+	}
+	if account.Entry != nil {
+		accountNote = account.Entry.comments()
+	}
+	if annotate {
+		sourceNote += "\n    ; mapped-by: " + source.String()
+		accountNote += "\n    ; mapped-by: " + account.String()
 	}
 
-	memo := row[memoIdx]
+	memo := row.Memo
 	memoText := ""
 	if memo != "" {
 		memoText = memo
 	}
 
-	return fmt.Sprintf("%s/%s/%s %s%s\n    %s  %s\n    %s  %s",
-		year, month, day, row[payeeIdx], memoText, source, outflow, ledgerAccount, inflow)
+	// Keep the original payee as metadata when a payee rule or mapping entry
+	// rewrote it
+	payee := entryOverride(source, account, func(e *MappingEntry) string { return e.Payee })
+	if payee == "" {
+		payee = mapPayee(mapping, row)
+	}
+	if payee != row.Payee {
+		memoText += "\n    ; ynab-payee: " + row.Payee
+	}
+
+	// Unparseable dates and amounts only affect ordering and balances, so
+	// they count as zero
+	date, _ := parseYNABDate(row.Date)
+	in, _ := parseAmount(inflow)
+	out, _ := parseAmount(outflow)
+	commodity := amountCommodity(outflow)
+	if commodity == "" {
+		commodity = amountCommodity(inflow)
+	}
+	if c := entryOverride(source, account, func(e *MappingEntry) string { return e.Commodity }); c != "" {
+		commodity = c
+		if outflow != "" {
+			outflow = formatAmount(out, commodity)
+		}
+		if inflow != "" {
+			inflow = formatAmount(in, commodity)
+		}
+	}
+
+	ledgerAccount := account.Account
+	return journalEntry{
+		Date:      date,
+		Account:   ledgerAccount,
+		Payee:     payee,
+		Amount:    in - out,
+		Commodity: commodity,
+		Postings: []entryPosting{
+			{Account: source.Account, Amount: out - in},
+			{Account: ledgerAccount, Amount: in - out},
+		},
+		Text: fmt.Sprintf("%s/%s/%s %s%s\n    %s  %s%s\n    %s  %s%s",
+			year, month, day, payee, memoText, source.Account, outflow, sourceNote, ledgerAccount, inflow, accountNote),
+	}, true
+}
+
+// entryOverride returns a field of the first of the matched mapping entries
+// that sets it, or "" when neither does.
+func entryOverride(first, second mappingMatch, field func(*MappingEntry) string) string {
+	for _, m := range []mappingMatch{first, second} {
+		if m.Entry != nil && field(m.Entry) != "" {
+			return field(m.Entry)
+		}
+	}
+	return ""
 }
 
+var zeroAmountRe = regexp.MustCompile(`\A(\$|€)?0(\.0+)?\z`)
+
 func blankIfZero(amount string) string {
-	re := regexp.MustCompile(`\A(\$|€)?0(\.0+)?\z`)
-	if re.MatchString(amount) {
+	if zeroAmountRe.MatchString(amount) {
 		return ""
 	}
 	return amount
@@ -393,63 +533,6 @@ func fixBareQuotes(content, delimiter string) string {
 	return strings.Join(lines, "\n")
 }
 
-// processFallback is a fallback method to parse the CSV file if the standard CSV parser fails
-func processFallback(content, delimiter string, mapping *Mapping) (string, error) {
-	lines := strings.Split(content, "\n")
-	if len(lines) < 2 {
-		return "", fmt.Errorf("not enough lines in the CSV file")
-	}
-
-	// Parse headers manually
-	headerLine := lines[0]
-	headers := parseCSVLine(headerLine, delimiter)
-
-	// Find the column indices for the fields we need
-	accountIdx := findColumnIndex(headers, "Account")
-	dateIdx := findColumnIndex(headers, "Date")
-	payeeIdx := findColumnIndex(headers, "Payee")
-	categoryGroupCategoryIdx := findColumnIndex(headers, "Category Group/Category")
-	memoIdx := findColumnIndex(headers, "Memo")
-	outflowIdx := findColumnIndex(headers, "Outflow")
-	inflowIdx := findColumnIndex(headers, "Inflow")
-
-	if accountIdx == -1 || dateIdx == -1 || payeeIdx == -1 ||
-		categoryGroupCategoryIdx == -1 || memoIdx == -1 ||
-		outflowIdx == -1 || inflowIdx == -1 {
-		return "", fmt.Errorf("required column not found in CSV. Headers found: %v", headers)
-	}
-
-	entries := []string{}
-
-	// Process each row
-	for i := 1; i < len(lines); i++ {
-		if strings.TrimSpace(lines[i]) == "" {
-			continue
-		}
-
-		row := parseCSVLine(lines[i], delimiter)
-		if len(row) <= max(accountIdx, dateIdx, payeeIdx, categoryGroupCategoryIdx, memoIdx, outflowIdx, inflowIdx) {
-			fmt.Printf("Warning: Skipping line %d due to insufficient fields\n", i+1)
-			continue
-		}
-
-		ledgerAccount := mapAccount(mapping, row[accountIdx])
-		ledgerCategory := mapCategory(mapping, row[categoryGroupCategoryIdx])
-
-		entry := ledgerEntry(row, accountIdx, dateIdx, payeeIdx, categoryGroupCategoryIdx, memoIdx, outflowIdx, inflowIdx, ledgerAccount, ledgerCategory, mapping)
-		if entry != "" {
-			entries = append(entries, entry)
-		}
-	}
-
-	// Reverse the entries as the original Ruby code does
-	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
-		entries[i], entries[j] = entries[j], entries[i]
-	}
-
-	return strings.Join(entries, "\n"), nil
-}
-
 // parseCSVLine parses a single CSV line manually
 func parseCSVLine(line, delimiter string) []string {
 	var fields []string
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"io"
 	"strings"
 	"testing"
 )
@@ -8,15 +9,15 @@ import (
 func TestProcess(t *testing.T) {
 	// Create a test mapping
 	testMapping := &Mapping{
-		Accounts: map[string]string{
+		Accounts: plainValues(map[string]string{
 			"Checking":         "Assets:Checking",
 			"Credit Card":      "Liabilities:Credit-Card",
 			"American Express": "Liabilities:Amex",
-		},
-		Categories: map[string]string{
+		}),
+		Categories: plainValues(map[string]string{
 			"Inflow: To be Budgeted":   "Income:Salary",
 			"Just for Fun: Dining Out": "Expenses:Food:Dining",
-		},
+		}),
 	}
 
 	tests := []struct {
@@ -83,3 +84,409 @@ func TestBlankIfZero(t *testing.T) {
 		})
 	}
 }
+
+func TestConvertSortOrder(t *testing.T) {
+	testMapping := &Mapping{
+		Accounts:   plainValues(map[string]string{"Checking": "Assets:Checking", "Savings": "Assets:Savings"}),
+		Categories: plainValues(map[string]string{"*": "Expenses:Misc"}),
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Savings","","01/02/2021","B","Bills: Rent","Bills","Rent","",$5.00,$0.00,"Cleared"
+"Checking","","01/02/2021","C","Bills: Rent","Bills","Rent","",$1.00,$0.00,"Cleared"
+"Checking","","12/31/2020","A","Bills: Rent","Bills","Rent","",$2.00,$0.00,"Cleared"`
+
+	tests := []struct {
+		sort, tieBreak string
+		payees         string
+	}{
+		{"date", "row", "ABC"},
+		{"date", "account", "ACB"},
+		{"date", "amount", "ABC"},
+		{"date-desc", "row", "BCA"},
+		{"source", "row", "BCA"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.sort+"/"+tc.tieBreak, func(t *testing.T) {
+			var sb strings.Builder
+			opts := convertOptions{Sort: tc.sort, TieBreak: tc.tieBreak}
+			if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+				t.Fatalf("convert() error = %v", err)
+			}
+
+			var payees string
+			for _, line := range strings.Split(sb.String(), "\n") {
+				if !strings.HasPrefix(line, " ") {
+					payees += line[len(line)-1:]
+				}
+			}
+			if payees != tc.payees {
+				t.Errorf("payee order = %s, want %s", payees, tc.payees)
+			}
+		})
+	}
+
+	if err := convert(strings.NewReader(csv), io.Discard, testMapping, convertOptions{Sort: "payee", TieBreak: "row"}); err == nil {
+		t.Error("convert() with an invalid sort order should fail")
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"$1.45", 1450},
+		{"$1,234.5", 1234500},
+		{"-€4.10", -4100},
+		{"$-0.01", -10},
+		{"", 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := parseAmount(tc.input)
+			if err != nil || got != tc.expected {
+				t.Errorf("parseAmount(%q) = %d, %v, want %d", tc.input, got, err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestConvertFilters(t *testing.T) {
+	testMapping := &Mapping{
+		Accounts: plainValues(map[string]string{
+			"Joint Checking":   "Assets:Joint",
+			"Personal Savings": "Assets:Savings",
+		}),
+		Categories: plainValues(map[string]string{"*": "Expenses:Misc"}),
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Personal Savings","","03/15/2021","Transfer : Joint Checking","","","","",$50.00,$0.00,"Cleared"
+"Joint Checking","","03/15/2021","Transfer : Personal Savings","","","","",$0.00,$50.00,"Cleared"
+"Joint Checking","","03/01/2021","Grocer","Food: Groceries","Food","Groceries","",$20.00,$0.00,"Cleared"
+"Personal Savings","","12/31/2020","Cafe","Fun: Coffee","Fun","Coffee","",$3.00,$0.00,"Cleared"`
+
+	tests := []struct {
+		name   string
+		opts   convertOptions
+		payees []string
+	}{
+		{"since", convertOptions{Since: "2021-01-01"}, []string{"Grocer", "Transfer : Joint Checking"}},
+		{"since with opening balances", convertOptions{Since: "2021-01-01", OpeningBalances: true}, []string{"Opening Balances", "Grocer", "Transfer : Joint Checking"}},
+		{"until", convertOptions{Until: "2021-03-01"}, []string{"Cafe", "Grocer"}},
+		{"inflow side of transfer", convertOptions{Accounts: []string{"Joint*"}}, []string{"Grocer", "Transfer : Joint Checking"}},
+		{"category", convertOptions{Categories: []string{"Fun: *"}}, []string{"Cafe"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.Sort, opts.TieBreak = "date", "row"
+
+			var sb strings.Builder
+			if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+				t.Fatalf("convert() error = %v", err)
+			}
+
+			var payees []string
+			for _, line := range strings.Split(sb.String(), "\n") {
+				if line != "" && !strings.HasPrefix(line, " ") {
+					payees = append(payees, strings.SplitN(line, " ", 2)[1])
+				}
+			}
+			if strings.Join(payees, "|") != strings.Join(tc.payees, "|") {
+				t.Errorf("payees = %q, want %q", payees, tc.payees)
+			}
+		})
+	}
+}
+
+func TestConvertOpeningBalances(t *testing.T) {
+	testMapping := &Mapping{
+		Accounts: plainValues(map[string]string{
+			"Checking":         "Assets:Checking",
+			"American Express": "Liabilities:Amex",
+		}),
+		Categories: plainValues(map[string]string{"*": "Expenses:Misc"}),
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","02/01/2021","Grocer","Food: Groceries","Food","Groceries","",$20.00,$0.00,"Cleared"
+"Checking","","01/15/2021","Transfer : American Express","","","","",$194.17,$0.00,"Cleared"
+"American Express","","01/15/2021","Transfer : Checking","","","","",$0.00,$194.17,"Cleared"
+"American Express","","01/10/2021","Cafe","Fun: Coffee","Fun","Coffee","",$300.50,$0.00,"Cleared"
+"Checking","","01/01/2021","Employer","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$1000.00,"Cleared"`
+
+	opts := defaultConvertOptions()
+	opts.Since = "2021-02-01"
+
+	var sb strings.Builder
+	if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+
+	expected := "2021/02/01 Opening Balances\n" +
+		"    Assets:Checking  $805.83\n" +
+		"    Liabilities:Amex  $-106.33\n" +
+		"    Equity:Opening Balances\n" +
+		"2021/02/01 Grocer\n    Expenses:Misc  $20.00\n    Assets:Checking  "
+	if sb.String() != expected {
+		t.Errorf("convert() = %q, want %q", sb.String(), expected)
+	}
+
+	// The opening entry stays first on its day with other tie-breakers
+	for _, tieBreak := range []string{"account", "amount"} {
+		opts.TieBreak = tieBreak
+		sb.Reset()
+		if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+			t.Fatalf("convert() error = %v", err)
+		}
+		if sb.String() != expected {
+			t.Errorf("convert() with --tie-break %s = %q, want %q", tieBreak, sb.String(), expected)
+		}
+	}
+
+	// and comes last on it, after the day's transactions, with date-desc
+	expected = "2021/02/01 Grocer\n    Expenses:Misc  $20.00\n    Assets:Checking  \n" +
+		"2021/02/01 Opening Balances\n" +
+		"    Assets:Checking  $805.83\n" +
+		"    Liabilities:Amex  $-106.33\n" +
+		"    Equity:Opening Balances"
+	opts.Sort = "date-desc"
+	for _, tieBreak := range []string{"row", "account", "amount"} {
+		opts.TieBreak = tieBreak
+		sb.Reset()
+		if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+			t.Fatalf("convert() error = %v", err)
+		}
+		if sb.String() != expected {
+			t.Errorf("convert() with --sort date-desc --tie-break %s = %q, want %q", tieBreak, sb.String(), expected)
+		}
+	}
+}
+
+func TestConvertPayeeRules(t *testing.T) {
+	testMapping, err := parseMapping([]byte(`
+accounts:
+  "Checking": Assets:Checking
+categories:
+  "*": Expenses:Misc
+payees:
+  - match: "/^(?i)(amzn|amazon)/"
+    name: Amazon
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","AMZN Mktp US*2K3","Shopping: Stuff","Shopping","Stuff","",$5.00,$0.00,"Cleared"
+"Checking","","01/03/2021","Corner Shop","Shopping: Stuff","Shopping","Stuff","",$1.00,$0.00,"Cleared"`
+
+	opts := defaultConvertOptions()
+	opts.DeclarePayees = true
+
+	var sb strings.Builder
+	if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+
+	expected := "payee Amazon\n" +
+		"2021/01/02 Amazon\n    ; ynab-payee: AMZN Mktp US*2K3\n    Expenses:Misc  $5.00\n    Assets:Checking  \n" +
+		"2021/01/03 Corner Shop\n    Expenses:Misc  $1.00\n    Assets:Checking  "
+	if sb.String() != expected {
+		t.Errorf("convert() = %q, want %q", sb.String(), expected)
+	}
+
+	// A category pattern restricts the name as well as the target, and a
+	// name in an entry of its own applies in every category
+	if testMapping, err = parseMapping([]byte(`
+accounts:
+  "Checking": Assets:Checking
+categories:
+  "*": Expenses:Misc
+payees:
+  - match: "ACME*"
+    category: "Inflow: *"
+    name: ACME Payroll
+    target: Income:Salary
+  - match: "Corner*"
+    category: "Inflow: *"
+    target: Income:Refunds
+  - match: "Corner*"
+    name: Corner Shop
+`)); err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	csv = `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","ACME Corp","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$900.00,"Cleared"
+"Checking","","01/03/2021","ACME Corp","Shopping: Stuff","Shopping","Stuff","",$5.00,$0.00,"Cleared"
+"Checking","","01/04/2021","Corner #12","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$2.00,"Cleared"
+"Checking","","01/05/2021","Corner #12","Shopping: Stuff","Shopping","Stuff","",$1.00,$0.00,"Cleared"`
+
+	sb.Reset()
+	if err := convert(strings.NewReader(csv), &sb, testMapping, defaultConvertOptions()); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+	expected = "2021/01/02 ACME Payroll\n    ; ynab-payee: ACME Corp\n    Income:Salary  \n    Assets:Checking  $900.00\n" +
+		"2021/01/03 ACME Corp\n    Expenses:Misc  $5.00\n    Assets:Checking  \n" +
+		"2021/01/04 Corner Shop\n    ; ynab-payee: Corner #12\n    Income:Refunds  \n    Assets:Checking  $2.00\n" +
+		"2021/01/05 Corner Shop\n    ; ynab-payee: Corner #12\n    Expenses:Misc  $1.00\n    Assets:Checking  "
+	if sb.String() != expected {
+		t.Errorf("convert() = %q, want %q", sb.String(), expected)
+	}
+}
+
+func TestConvertAnnotateMapping(t *testing.T) {
+	testMapping, err := parseMapping([]byte(`
+accounts:
+  "Business Visa": Liabilities:Business
+categories:
+  "Food: Groceries":
+    - account: Expenses:Business:Meals
+      when: {account: "Business*"}
+    - Expenses:Food:Groceries
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Business Visa","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"`
+
+	opts := defaultConvertOptions()
+	opts.AnnotateMapping = true
+
+	var sb strings.Builder
+	if err := convert(strings.NewReader(csv), &sb, testMapping, opts); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+
+	expected := "2021/01/02 Grocer\n" +
+		"    Expenses:Business:Meals  $5.00\n" +
+		"    ; mapped-by: categories[\"Food: Groceries\"] entry 1 when account Business* (line 6)\n" +
+		"    Liabilities:Business  \n" +
+		"    ; mapped-by: accounts[\"Business Visa\"] (line 3)"
+	if sb.String() != expected {
+		t.Errorf("convert() = %q, want %q", sb.String(), expected)
+	}
+}
+
+func TestConvertRichEntries(t *testing.T) {
+	testMapping, err := parseMapping([]byte(`
+accounts:
+  "Checking": Assets:Checking
+  "Canada Card":
+    account: Liabilities:Canada
+    commodity: CAD
+categories:
+  "Health: Medical":
+    account: Expenses:Medical
+    tags: [hsa-eligible]
+  "Home: Improvement":
+    account: Expenses:Home
+    metadata: {project: renovation, contractor: Bob}
+    payee: Home Depot
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Clinic","Health: Medical","Health","Medical","",$20.00,$0.00,"Cleared"
+"Checking","","01/03/2021","HD #123","Home: Improvement","Home","Improvement","",$99.50,$0.00,"Cleared"
+"Canada Card","","01/04/2021","Clinic","Health: Medical","Health","Medical","",41.04,0.00,"Cleared"`
+
+	var sb strings.Builder
+	if err := convert(strings.NewReader(csv), &sb, testMapping, defaultConvertOptions()); err != nil {
+		t.Fatalf("convert() error = %v", err)
+	}
+
+	expected := "2021/01/02 Clinic\n    Expenses:Medical  $20.00\n    ; :hsa-eligible:\n    Assets:Checking  \n" +
+		"2021/01/03 Home Depot\n    ; ynab-payee: HD #123\n    Expenses:Home  $99.50\n    ; contractor: Bob\n    ; project: renovation\n    Assets:Checking  \n" +
+		"2021/01/04 Clinic\n    Expenses:Medical  41.04 CAD\n    ; :hsa-eligible:\n    Liabilities:Canada  "
+	if sb.String() != expected {
+		t.Errorf("convert() = %q, want %q", sb.String(), expected)
+	}
+
+	for _, bad := range []string{
+		"categories:\n  x:\n    account: y\n    tags: [\"two words\"]\n",
+		"categories:\n  x:\n    account: y\n    metadata: {\"a:b\": c}\n",
+		"categories:\n  x:\n    account: y\n    commodity: \"1X\"\n",
+		"categories:\n  x:\n    account: y\n    tags: nope\n",
+	} {
+		if _, err := parseMapping([]byte(bad)); err == nil {
+			t.Errorf("parseMapping(%q) should fail", bad)
+		}
+	}
+}
+
+func TestConvertExclusions(t *testing.T) {
+	testMapping, err := parseMapping([]byte(`
+accounts:
+  "Checking": Assets:Checking
+  "Kid Allowance":
+    ignore: true
+categories:
+  "*": Expenses:Misc
+  "Test: Scratch":
+    ignore: true
+exclude:
+  - payee: "Test *"
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Kid Allowance","","01/03/2021","Candy","Fun: Candy","Fun","Candy","",$1.00,$0.00,"Cleared"
+"Checking","","01/04/2021","Transfer : Kid Allowance","","","","",$10.00,$0.00,"Cleared"
+"Kid Allowance","","01/04/2021","Transfer : Checking","","","","",$0.00,$10.00,"Cleared"
+"Checking","","01/05/2021","Shop","Test: Scratch","Test","Scratch","",$2.00,$0.00,"Cleared"
+"Checking","","01/06/2021","Test Payee","Food: Groceries","Food","Groceries","",$0.00,$3.00,"Cleared"`
+
+	var sb strings.Builder
+	out := newJournalStream(&sb)
+	excluded, err := convertTo(strings.NewReader(csv), out, testMapping, defaultConvertOptions())
+	if err != nil {
+		t.Fatalf("convertTo() error = %v", err)
+	}
+	out.Close()
+
+	if want := "2021/01/02 Grocer\n    Expenses:Misc  $5.00\n    Assets:Checking  "; sb.String() != want {
+		t.Errorf("convertTo() wrote %q, want only %q", sb.String(), want)
+	}
+	if excluded.Rows != 5 || excluded.Outflow != 13000 || excluded.Inflow != 13000 {
+		t.Errorf("excluded = %d rows, outflow %d, inflow %d, want 5, 13000, 13000", excluded.Rows, excluded.Outflow, excluded.Inflow)
+	}
+
+	var summary strings.Builder
+	excluded.print(&summary)
+	expected := "Excluded 5 rows (outflow $13.00, inflow $13.00):\n" +
+		"  accounts[\"Kid Allowance\"] (line 5): 3 rows (outflow $11.00, inflow $10.00)\n" +
+		"  categories[\"Test: Scratch\"] (line 9): 1 row (outflow $2.00, inflow $0.00)\n" +
+		"  exclude[1] (line 11): 1 row (outflow $0.00, inflow $3.00)\n"
+	if summary.String() != expected {
+		t.Errorf("print() = %q, want %q", summary.String(), expected)
+	}
+
+	// Rows outside the date range are not counted, and excluded rows
+	// before it stay out of the opening balances
+	opts := defaultConvertOptions()
+	opts.Since = "2021-01-04"
+	opts.Until = "2021-01-05"
+	sb.Reset()
+	out = newJournalStream(&sb)
+	excluded, err = convertTo(strings.NewReader(csv), out, testMapping, opts)
+	if err != nil {
+		t.Fatalf("convertTo() error = %v", err)
+	}
+	out.Close()
+	if want := "2021/01/04 Opening Balances\n    Assets:Checking  $-5.00\n    Equity:Opening Balances"; sb.String() != want {
+		t.Errorf("convertTo() wrote %q, want %q", sb.String(), want)
+	}
+	if excluded.Rows != 3 || excluded.Outflow != 12000 || excluded.Inflow != 10000 {
+		t.Errorf("excluded = %d rows, outflow %d, inflow %d, want 3, 12000, 10000", excluded.Rows, excluded.Outflow, excluded.Inflow)
+	}
+
+	if _, err := parseMapping([]byte("exclude:\n  - payee: x\n    target: y\n")); err == nil {
+		t.Error("parseMapping() should reject an exclude rule with a target")
+	}
+}
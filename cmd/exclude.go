@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+)
+
+// excluded reports whether a row must be left out of the journal, and names
+// the exclude rule or ignored mapping entry responsible. A transfer is left
+// out when either of its accounts is ignored, so that both sides go together.
+func (m *Mapping) excluded(row ynabRow) (mappingMatch, bool) {
+	for i := range m.Exclude {
+		if _, ok := m.Exclude[i].match(row); ok {
+			return mappingMatch{
+				Source: fmt.Sprintf("exclude[%d]", i+1),
+				Line:   m.Exclude[i].Line,
+				Ref:    mappingRef{Section: "exclude", Index: i},
+			}, true
+		}
+	}
+
+	candidates := []mappingMatch{resolveAccount(m, row)}
+	if other, ok := transferAccount(row.Payee); ok {
+		candidates = append(candidates, resolveAccount(m, row.withAccount(other)))
+	} else {
+		candidates = append(candidates, resolveCategory(m, row))
+	}
+	for _, match := range candidates {
+		if match.Entry != nil && match.Entry.Ignore {
+			return match, true
+		}
+	}
+	return mappingMatch{}, false
+}
+
+// exclusionSummary counts the rows left out of a conversion and the money
+// they moved, in total and by the rule or entry that excluded them.
+type exclusionSummary struct {
+	Rows      int
+	Outflow   int64 // milliunits
+	Inflow    int64 // milliunits
+	Commodity string
+
+	sources []string // in order of first use
+	counts  map[string]*exclusionCount
+}
+
+type exclusionCount struct {
+	rows            int
+	outflow, inflow int64
+}
+
+func (s *exclusionSummary) add(row ynabRow, match mappingMatch) {
+	outflow, _ := parseAmount(row.Outflow)
+	inflow, _ := parseAmount(row.Inflow)
+	if s.Commodity == "" {
+		s.Commodity = amountCommodity(row.Outflow)
+		if s.Commodity == "" {
+			s.Commodity = amountCommodity(row.Inflow)
+		}
+	}
+	s.Rows++
+	s.Outflow += outflow
+	s.Inflow += inflow
+
+	if s.counts == nil {
+		s.counts = make(map[string]*exclusionCount)
+	}
+	source := match.String()
+	c, ok := s.counts[source]
+	if !ok {
+		c = &exclusionCount{}
+		s.counts[source] = c
+		s.sources = append(s.sources, source)
+	}
+	c.rows++
+	c.outflow += outflow
+	c.inflow += inflow
+}
+
+// print writes the summary, or nothing when no row was excluded.
+func (s *exclusionSummary) print(w io.Writer) {
+	if s.Rows == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Excluded %s (outflow %s, inflow %s):\n", pluralRows(s.Rows),
+		formatAmount(s.Outflow, s.Commodity), formatAmount(s.Inflow, s.Commodity))
+	for _, source := range s.sources {
+		c := s.counts[source]
+		fmt.Fprintf(w, "  %s: %s (outflow %s, inflow %s)\n", source, pluralRows(c.rows),
+			formatAmount(c.outflow, s.Commodity), formatAmount(c.inflow, s.Commodity))
+	}
+}
+
+func pluralRows(n int) string {
+	if n == 1 {
+		return "1 row"
+	}
+	return fmt.Sprintf("%d rows", n)
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// explainOptions selects what the explain command describes: either a row of
+// a register export, by its line number, or names given on the command line.
+type explainOptions struct {
+	Row      int // line in the export, counting the header as line 1
+	Account  string
+	Category string
+	Payee    string
+	Date     string // yyyy-mm-dd, for date-bounded entries and rules
+}
+
+// explainFile loads the mapping and explains how a row or a set of names is
+// mapped, writing the explanation to stdout.
+func explainFile(args []string, opts explainOptions) error {
+	mapping, err := loadMapping(mappingFile)
+	if err != nil {
+		return fmt.Errorf("error loading mapping: %w", err)
+	}
+
+	if opts.Row == 0 {
+		if len(args) > 0 {
+			return fmt.Errorf("a register export needs --row")
+		}
+		if opts.Account == "" && opts.Category == "" && opts.Payee == "" {
+			return fmt.Errorf("give --row, or at least one of --account, --category and --payee")
+		}
+		row := ynabRow{Account: opts.Account, Category: opts.Category, Payee: opts.Payee}
+		if opts.Date != "" {
+			date, err := time.Parse(filterDateLayout, opts.Date)
+			if err != nil {
+				return fmt.Errorf("invalid --date %q (want yyyy-mm-dd)", opts.Date)
+			}
+			row.Date = date.Format("01/02/2006")
+		}
+		explain(os.Stdout, mapping, row, false)
+		return nil
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("--row needs a register export")
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	row, err := findRow(file, opts.Row)
+	if err != nil {
+		return err
+	}
+	explain(os.Stdout, mapping, row, true)
+	return nil
+}
+
+// findRow reads a register export up to the row on the given line.
+func findRow(r io.Reader, line int) (ynabRow, error) {
+	rows, err := newRegisterReader(r)
+	if err != nil {
+		return ynabRow{}, err
+	}
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return ynabRow{}, fmt.Errorf("no transaction on line %d", line)
+		}
+		if err != nil {
+			return ynabRow{}, fmt.Errorf("error reading row: %w", err)
+		}
+		if row.Line == line {
+			return row, nil
+		}
+	}
+}
+
+// explain writes every mapping step tried for each side of a row and what it
+// produced. With render set, the transaction the row converts to follows,
+// annotated with the source of each posting's account.
+func explain(w io.Writer, mapping *Mapping, row ynabRow, render bool) {
+	if render {
+		fmt.Fprintf(w, "Line %d: %s, %s, payee %q, category %q, outflow %q, inflow %q\n",
+			row.Line, row.Account, row.Date, row.Payee, row.Category, row.Outflow, row.Inflow)
+	}
+
+	if match, ok := mapping.excluded(row); ok {
+		fmt.Fprintf(w, "Excluded by %s\n", match)
+		return
+	}
+
+	if row.Payee != "" {
+		if match, ok := mapping.matchPayeeName(row); ok {
+			fmt.Fprintf(w, "Payee %q: renamed to %q by %s\n", row.Payee, match.Account, match)
+		} else {
+			fmt.Fprintf(w, "Payee %q: unchanged\n", row.Payee)
+		}
+	}
+
+	var account, category mappingMatch
+	if row.Account != "" || render {
+		fmt.Fprintf(w, "Account %q:\n", row.Account)
+		account = explainSide(w, mapping, accountSteps, row, "Assets:Unknown")
+	}
+	if other, ok := transferAccount(row.Payee); ok {
+		fmt.Fprintf(w, "Transfer account %q:\n", other)
+		category = explainSide(w, mapping, accountSteps, row.withAccount(other), "Assets:Unknown")
+	} else if row.Category != "" || render {
+		fmt.Fprintf(w, "Category %q:\n", row.Category)
+		category = explainSide(w, mapping, categorySteps, row, "Expenses:Unknown")
+	}
+
+	if !render {
+		return
+	}
+	e, ok := ledgerEntry(row, account, category, mapping, true)
+	if !ok {
+		fmt.Fprintln(w, "No transaction: the row has a zero amount or a malformed date, or is the inflow side of a transfer")
+		return
+	}
+	fmt.Fprintf(w, "Transaction:\n%s\n", e.Text)
+}
+
+// explainSide traces the steps of one side of a row.
+func explainSide(w io.Writer, mapping *Mapping, steps []mappingStep, row ynabRow, fallback string) mappingMatch {
+	match := mapping.resolve(steps, row, fallback, func(step string, match mappingMatch, ok bool) {
+		if ok {
+			fmt.Fprintf(w, "  %-15s %s -> %s\n", step+":", match, match.Account)
+		} else {
+			fmt.Fprintf(w, "  %-15s no match\n", step+":")
+		}
+	})
+	if match.Source == "default" {
+		fmt.Fprintf(w, "  %-15s %s\n", "default:", match.Account)
+	}
+	return match
+}
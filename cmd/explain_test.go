@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	testMapping, err := parseMapping([]byte(`
+accounts:
+  "Checking": Assets:Checking
+rules:
+  - category: "/^Bills: (.*)$/"
+    target: Expenses:Bills:$1
+payees:
+  - match: "Power*"
+    name: Power Company
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Checking","","01/03/2021","Power Co","Bills: Electric","Bills","Electric","",$50.00,$0.00,"Cleared"`
+
+	row, err := findRow(strings.NewReader(csv), 3)
+	if err != nil {
+		t.Fatalf("findRow() error = %v", err)
+	}
+
+	var sb strings.Builder
+	explain(&sb, testMapping, row, true)
+
+	expected := `Line 3: Checking, 01/03/2021, payee "Power Co", category "Bills: Electric", outflow "$50.00", inflow "$0.00"
+Payee "Power Co": renamed to "Power Company" by payees[1] (line 8)
+Account "Checking":
+  exact key:      accounts["Checking"] (line 3) -> Assets:Checking
+Category "Bills: Electric":
+  payee targets:  no match
+  exact key:      no match
+  category rules: rules[1] (line 5) -> Expenses:Bills:Electric
+Transaction:
+2021/01/03 Power Company
+    ; ynab-payee: Power Co
+    Expenses:Bills:Electric  $50.00
+    ; mapped-by: rules[1] (line 5)
+    Assets:Checking  
+    ; mapped-by: accounts["Checking"] (line 3)
+`
+	if sb.String() != expected {
+		t.Errorf("explain() = %q, want %q", sb.String(), expected)
+	}
+
+	if _, err := findRow(strings.NewReader(csv), 9); err == nil {
+		t.Error("findRow() should fail for a line past the end")
+	}
+}
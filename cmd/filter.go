@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// filterDateLayout is the format accepted by --since and --until.
+const filterDateLayout = "2006-01-02"
+
+// rowFilter selects the register rows that take part in a conversion. It
+// works on the raw YNAB fields, before any mapping is applied.
+type rowFilter struct {
+	since      time.Time // zero means unbounded
+	until      time.Time // inclusive; zero means unbounded
+	accounts   []*regexp.Regexp
+	categories []*regexp.Regexp
+}
+
+func newRowFilter(opts convertOptions) (*rowFilter, error) {
+	f := &rowFilter{}
+	var err error
+	if opts.Since != "" {
+		if f.since, err = time.Parse(filterDateLayout, opts.Since); err != nil {
+			return nil, fmt.Errorf("invalid --since date %q (want yyyy-mm-dd)", opts.Since)
+		}
+	}
+	if opts.Until != "" {
+		if f.until, err = time.Parse(filterDateLayout, opts.Until); err != nil {
+			return nil, fmt.Errorf("invalid --until date %q (want yyyy-mm-dd)", opts.Until)
+		}
+	}
+	if f.accounts, err = compileGlobs(opts.Accounts); err != nil {
+		return nil, fmt.Errorf("invalid --account pattern: %w", err)
+	}
+	if f.categories, err = compileGlobs(opts.Categories); err != nil {
+		return nil, fmt.Errorf("invalid --category pattern: %w", err)
+	}
+	return f, nil
+}
+
+// matchDate reports whether date falls inside the --since/--until range. A
+// zero (unparseable) date only matches when no range is set.
+func (f *rowFilter) matchDate(date time.Time) bool {
+	if date.IsZero() {
+		return f.since.IsZero() && f.until.IsZero()
+	}
+	if !f.since.IsZero() && date.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && date.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// matchFields reports whether a row passes the account and category filters.
+// A transfer passes the account filter when either of its sides matches, so
+// that transfers into a selected account are not lost: they are only ever
+// rendered from their outflow side, which may be an unselected account.
+func (f *rowFilter) matchFields(row ynabRow) bool {
+	if len(f.accounts) > 0 {
+		ok := matchAny(f.accounts, row.Account)
+		if other, isTransfer := transferAccount(row.Payee); isTransfer && !ok {
+			ok = matchAny(f.accounts, other)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(f.categories) > 0 && !matchAny(f.categories, row.Category) {
+		return false
+	}
+	return true
+}
+
+// transferAccount returns the other account named in a transfer payee such as
+// "Transfer : Savings".
+func transferAccount(payee string) (string, bool) {
+	if !strings.Contains(payee, "Transfer :") {
+		return "", false
+	}
+	parts := strings.Split(payee, ":")
+	return strings.TrimSpace(parts[len(parts)-1]), true
+}
+
+// compileGlob turns a shell-style glob into an anchored regular expression.
+// Each * or ? becomes a capture group, so the matched text can be reused.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString(`\A`)
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(`(.*)`)
+		case '?':
+			sb.WriteString(`(.)`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString(`\z`)
+	return regexp.Compile(sb.String())
+}
+
+func compileGlobs(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := compileGlob(p)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
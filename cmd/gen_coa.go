@@ -1,13 +1,63 @@
 package cmd
 
 import (
-	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 )
 
+// coaOptions controls how gen-coa builds a mapping file.
+type coaOptions struct {
+	// Merge adds the names that are new in the register to an existing
+	// mapping file instead of overwriting it.
+	Merge bool
+
+	// LiabilityNames are patterns of account names suggested as
+	// Liabilities, such as credit cards and loans.
+	LiabilityNames []string
+	// NegativeShare suggests Liabilities for the accounts whose balance is
+	// negative on more than this share of the days they are used. 0 turns
+	// the check off.
+	NegativeShare float64
+	// IncomeCategories are patterns of categories suggested as Income.
+	IncomeCategories []string
+	// EquityPayees are patterns of payees, such as YNAB's Starting Balance,
+	// whose rows are mapped to EquityAccount by a payee rule.
+	EquityPayees  []string
+	EquityAccount string
+
+	// Naming is how YNAB names become account name segments: "spaces"
+	// keeps them as they are, "title" writes TitleCase and "kebab"
+	// kebab-case.
+	Naming string
+
+	// Sort orders the entries of each section by name or by volume, the
+	// money they moved, largest first.
+	Sort string
+
+	// LearnFrom is an existing Ledger journal whose transactions are
+	// matched to the rows of the export to suggest the accounts they were
+	// posted to.
+	LearnFrom string
+}
+
+func defaultCOAOptions() coaOptions {
+	return coaOptions{
+		LiabilityNames:   []string{"/(?i)(visa|amex|card|loan|mortgage)/"},
+		NegativeShare:    0.5,
+		IncomeCategories: []string{"Inflow: *"},
+		EquityPayees:     []string{"Starting Balance"},
+		EquityAccount:    "Equity:Opening Balances",
+		Naming:           "spaces",
+		Sort:             "name",
+	}
+}
+
 func GenerateCOA(csvFile, yamlFile string) error {
 	file, err := os.Open(csvFile)
 	if err != nil {
@@ -15,73 +65,508 @@ func GenerateCOA(csvFile, yamlFile string) error {
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
-	reader.LazyQuotes = true
-
-	headers, err := reader.Read()
+	scan, err := scanRegister(file)
+	if err != nil {
+		return err
+	}
+	if coaOpts.LearnFrom != "" {
+		if scan.learned, err = learnFromJournal(file, coaOpts.LearnFrom); err != nil {
+			return err
+		}
+		fmt.Printf("Matched %d of %d rows to %s\n", scan.learned.matched, scan.learned.rows, coaOpts.LearnFrom)
+	}
+	suggest, err := newCOASuggester(coaOpts, scan)
 	if err != nil {
-		return fmt.Errorf("could not read CSV header: %w", err)
+		return err
+	}
+	for _, w := range suggest.warnings {
+		fmt.Println("warning: " + w)
 	}
 
-	accountIdx := findColumnIndex(headers, "Account")
-	categoryGroupCategoryIdx := findColumnIndex(headers, "Category Group/Category")
+	if coaOpts.Merge {
+		existing, err := os.ReadFile(yamlFile)
+		if err == nil {
+			merged, report, err := mergeCOA(existing, suggest)
+			if err != nil {
+				return fmt.Errorf("could not merge into %s: %w", yamlFile, err)
+			}
+			fmt.Print(report)
+			return os.WriteFile(yamlFile, merged, 0644)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
 
-	if accountIdx == -1 || categoryGroupCategoryIdx == -1 {
-		return fmt.Errorf("required columns not found in CSV headers: %v", headers)
+	return os.WriteFile(yamlFile, []byte(suggest.coa()), 0644)
+}
+
+// registerScan is what gen-coa learns from a register export.
+type registerScan struct {
+	accounts   map[string]*accountUsage
+	categories map[string]*nameUsage
+	// transfers are the accounts named by transfer payees, which include
+	// accounts that have no rows of their own in the export, with the
+	// usage seen from the other side
+	transfers map[string]*nameUsage
+	payees    map[string]struct{}
+	commodity string
+	// learned is what an existing journal says about the names, if one
+	// was given
+	learned *learnedMappings
+}
+
+// nameUsage sums up the rows of an account or category.
+type nameUsage struct {
+	count           int
+	outflow, inflow int64 // milliunits
+	first, last     time.Time
+}
+
+// accountUsage is the usage of a YNAB account and the net amount it moved
+// on each day.
+type accountUsage struct {
+	nameUsage
+	daily map[time.Time]int64 // milliunits
+}
+
+func (u *nameUsage) add(date time.Time, outflow, inflow int64) {
+	u.count++
+	u.outflow += outflow
+	u.inflow += inflow
+	if date.IsZero() {
+		return
+	}
+	if u.first.IsZero() || date.Before(u.first) {
+		u.first = date
 	}
+	if date.After(u.last) {
+		u.last = date
+	}
+}
+
+// volume is the money moved in either direction.
+func (u *nameUsage) volume() int64 {
+	return u.outflow + u.inflow
+}
+
+// describe summarises the usage for a comment.
+func (u *nameUsage) describe(commodity string) string {
+	rows := "1 transaction"
+	if u.count != 1 {
+		rows = fmt.Sprintf("%d transactions", u.count)
+	}
+	text := fmt.Sprintf("%s, outflow %s, inflow %s", rows, formatAmount(u.outflow, commodity), formatAmount(u.inflow, commodity))
+	if !u.first.IsZero() {
+		text += fmt.Sprintf(", %s to %s", u.first.Format(filterDateLayout), u.last.Format(filterDateLayout))
+	}
+	return text
+}
 
-	accountsSet := make(map[string]struct{})
-	categoriesSet := make(map[string]struct{})
+// scanRegister reads a register export and collects its names, their usage
+// and the daily movements of its accounts.
+func scanRegister(r io.Reader) (*registerScan, error) {
+	rows, err := newRegisterReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %w", err)
+	}
 
+	scan := &registerScan{
+		accounts:   make(map[string]*accountUsage),
+		categories: make(map[string]*nameUsage),
+		transfers:  make(map[string]*nameUsage),
+		payees:     make(map[string]struct{}),
+	}
 	for {
-		row, err := reader.Read()
-		if err != nil {
+		row, err := rows.Read()
+		if err == io.EOF {
 			break
 		}
-		if len(row) <= accountIdx || len(row) <= categoryGroupCategoryIdx {
+		if err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+
+		date, _ := parseYNABDate(row.Date)
+		inflow, _ := parseAmount(row.Inflow)
+		outflow, _ := parseAmount(row.Outflow)
+		if scan.commodity == "" {
+			scan.commodity = amountCommodity(row.Outflow)
+		}
+
+		usage, ok := scan.accounts[row.Account]
+		if !ok {
+			usage = &accountUsage{daily: make(map[time.Time]int64)}
+			scan.accounts[row.Account] = usage
+		}
+		usage.add(date, outflow, inflow)
+		if !date.IsZero() {
+			usage.daily[date] += inflow - outflow
+		}
+
+		if other, ok := transferAccount(row.Payee); ok {
+			if scan.transfers[other] == nil {
+				scan.transfers[other] = &nameUsage{}
+			}
+			scan.transfers[other].add(date, inflow, outflow)
 			continue
 		}
-		accountsSet[row[accountIdx]] = struct{}{}
-		categoriesSet[row[categoryGroupCategoryIdx]] = struct{}{}
+		scan.payees[row.Payee] = struct{}{}
+		if row.Category != "" {
+			if scan.categories[row.Category] == nil {
+				scan.categories[row.Category] = &nameUsage{}
+			}
+			scan.categories[row.Category].add(date, outflow, inflow)
+		}
 	}
+	return scan, nil
+}
 
-	accounts := make([]string, 0, len(accountsSet))
-	for k := range accountsSet {
-		accounts = append(accounts, k)
+// accountNames returns the accounts of the export, including those only seen
+// through transfers, in order.
+func (s *registerScan) accountNames() []string {
+	names := make(map[string]struct{}, len(s.accounts)+len(s.transfers))
+	for name := range s.accounts {
+		names[name] = struct{}{}
 	}
-	sort.Strings(accounts)
+	for name := range s.transfers {
+		names[name] = struct{}{}
+	}
+	return sortedKeys(names)
+}
+
+func (s *registerScan) categoryNames() []string {
+	return sortedKeys(s.categories)
+}
 
-	categories := make([]string, 0, len(categoriesSet))
-	for k := range categoriesSet {
-		categories = append(categories, k)
+// usage returns the usage of a name of a section. An account without rows
+// of its own is described by the transfers that name it.
+func (s *registerScan) usage(section, name string) *nameUsage {
+	if section == "categories" {
+		return s.categories[name]
 	}
-	sort.Strings(categories)
+	if u, ok := s.accounts[name]; ok {
+		return &u.nameUsage
+	}
+	return s.transfers[name]
+}
+
+// ordered returns the names of a section by name, or by volume with the
+// largest first.
+func (s *registerScan) ordered(section, by string) []string {
+	names := s.accountNames()
+	if section == "categories" {
+		names = s.categoryNames()
+	}
+	if by == "volume" {
+		sort.SliceStable(names, func(i, j int) bool {
+			return s.usage(section, names[i]).volume() > s.usage(section, names[j]).volume()
+		})
+	}
+	return names
+}
+
+// negativeShare returns the share of the days an account was used on which
+// its running balance was below zero.
+func (u *accountUsage) negativeShare() float64 {
+	if len(u.daily) == 0 {
+		return 0
+	}
+	dates := make([]time.Time, 0, len(u.daily))
+	for date := range u.daily {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	var balance int64
+	negative := 0
+	for _, date := range dates {
+		balance += u.daily[date]
+		if balance < 0 {
+			negative++
+		}
+	}
+	return float64(negative) / float64(len(dates))
+}
+
+func sortedKeys[V any](set map[string]V) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// coaSuggester proposes the Ledger account for each name of a register
+// export, along with a note on why when it is not the plain default.
+type coaSuggester struct {
+	opts             coaOptions
+	scan             *registerScan
+	liabilityNames   []namePattern
+	incomeCategories []namePattern
+	equityPayees     []namePattern
 
+	suggestions map[coaName]suggestion
+	// warnings describe the names whose suggestions collided
+	warnings []string
+}
+
+// coaName is an account or category name of the export.
+type coaName struct {
+	section string // accounts or categories
+	name    string
+}
+
+type suggestion struct {
+	target, note string
+}
+
+// namePattern is a compiled glob or /regex/ that remembers how it was
+// written, for notes.
+type namePattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newCOASuggester(opts coaOptions, scan *registerScan) (*coaSuggester, error) {
+	if !slices.Contains(namingStyles, opts.Naming) {
+		return nil, fmt.Errorf("invalid --naming %q (want %s)", opts.Naming, strings.Join(namingStyles, ", "))
+	}
+	if opts.Sort != "name" && opts.Sort != "volume" {
+		return nil, fmt.Errorf("invalid --sort %q (want name or volume)", opts.Sort)
+	}
+	s := &coaSuggester{opts: opts, scan: scan}
+	for _, p := range []struct {
+		flag     string
+		patterns []string
+		res      *[]namePattern
+	}{
+		{"--liability-name", opts.LiabilityNames, &s.liabilityNames},
+		{"--income-category", opts.IncomeCategories, &s.incomeCategories},
+		{"--equity-payee", opts.EquityPayees, &s.equityPayees},
+	} {
+		for _, pattern := range p.patterns {
+			re, err := compilePattern(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", p.flag, pattern, err)
+			}
+			*p.res = append(*p.res, namePattern{pattern, re})
+		}
+	}
+	s.suggestAll()
+	return s, nil
+}
+
+// suggestAll suggests an account for every name of the export, preferring
+// the one learned from a journal. Names whose inferred suggestions collide,
+// ignoring case, keep them in order of section and name but for the first,
+// which get a number appended instead.
+func (s *coaSuggester) suggestAll() {
+	var names []coaName
+	for _, name := range s.scan.accountNames() {
+		names = append(names, coaName{"accounts", name})
+	}
+	for _, name := range s.scan.categoryNames() {
+		names = append(names, coaName{"categories", name})
+	}
+
+	s.suggestions = make(map[coaName]suggestion, len(names))
+	byTarget := make(map[string][]coaName)
+	var targets []string
+	for _, n := range names {
+		var sg suggestion
+		if learned, ok := s.scan.learned.best(n); ok {
+			// The journal's choice is deliberate, so it is kept even
+			// when it is shared with other names
+			s.suggestions[n] = suggestion{learned.Account, learned.note()}
+			continue
+		}
+		if n.section == "accounts" {
+			sg.target, sg.note = s.inferAccount(n.name)
+		} else {
+			sg.target, sg.note = s.inferCategory(n.name)
+		}
+		s.suggestions[n] = sg
+		key := strings.ToLower(sg.target)
+		if _, ok := byTarget[key]; !ok {
+			targets = append(targets, key)
+		}
+		byTarget[key] = append(byTarget[key], n)
+	}
+
+	for _, key := range targets {
+		colliding := byTarget[key]
+		if len(colliding) < 2 {
+			continue
+		}
+		target := s.suggestions[colliding[0]].target
+		quoted := make([]string, len(colliding))
+		for i, n := range colliding {
+			quoted[i] = fmt.Sprintf("%s[%q]", n.section, n.name)
+		}
+		s.warnings = append(s.warnings, fmt.Sprintf("%s would all map to %s; numbering all but the first", strings.Join(quoted, ", "), target))
+
+		next := 2
+		for _, n := range colliding[1:] {
+			sg := s.suggestions[n]
+			// Skip numbers that are some other name's target already
+			for byTarget[strings.ToLower(s.numbered(sg.target, next))] != nil {
+				next++
+			}
+			sg.target = s.numbered(sg.target, next)
+			next++
+			byTarget[strings.ToLower(sg.target)] = []coaName{n}
+			note := fmt.Sprintf("renamed: %s[%q] also maps to %s", colliding[0].section, colliding[0].name, target)
+			if sg.note != "" {
+				note = sg.note + "; " + note
+			}
+			sg.note = note
+			s.suggestions[n] = sg
+		}
+	}
+}
+
+// numbered appends a number to the last segment of an account name in the
+// configured naming style.
+func (s *coaSuggester) numbered(target string, n int) string {
+	switch s.opts.Naming {
+	case "title":
+		return fmt.Sprintf("%s%d", target, n)
+	case "kebab":
+		return fmt.Sprintf("%s-%d", target, n)
+	default:
+		return fmt.Sprintf("%s %d", target, n)
+	}
+}
+
+// account and category return the suggestion for a name of the export.
+func (s *coaSuggester) account(name string) (target, note string) {
+	sg := s.suggestions[coaName{"accounts", name}]
+	return sg.target, sg.note
+}
+
+func (s *coaSuggester) category(name string) (target, note string) {
+	sg := s.suggestions[coaName{"categories", name}]
+	return sg.target, sg.note
+}
+
+// inferAccount suggests the Ledger account of a YNAB account: Liabilities for
+// names that look like credit cards or loans and for accounts that are
+// mostly overdrawn, Assets otherwise. Accounts without rows of their own are
+// noted as tracking accounts.
+func (s *coaSuggester) inferAccount(name string) (target, note string) {
+	var notes []string
+	target = "Assets:Bank:" + s.segment(name)
+
+	usage, hasRows := s.scan.accounts[name]
+	if pattern, ok := firstMatch(s.liabilityNames, name); ok {
+		target = "Liabilities:" + s.segment(name)
+		notes = append(notes, "liability: name matches "+pattern)
+	} else if hasRows && s.opts.NegativeShare > 0 {
+		if share := usage.negativeShare(); share > s.opts.NegativeShare {
+			target = "Liabilities:" + s.segment(name)
+			notes = append(notes, fmt.Sprintf("liability: balance negative on %.0f%% of days", share*100))
+		}
+	}
+	if !hasRows {
+		// Off-budget tracking accounts such as a house or a loan are
+		// often only recorded through transfers
+		if !strings.HasPrefix(target, "Liabilities:") {
+			target = "Assets:" + s.segment(name)
+		}
+		notes = append(notes, "tracking account: only seen through transfers")
+	}
+	return target, strings.Join(notes, "; ")
+}
+
+// inferCategory suggests the Ledger account of a YNAB category: Income for
+// inflow categories, named without their group, and Expenses otherwise,
+// with the category nested under its group.
+func (s *coaSuggester) inferCategory(name string) (target, note string) {
+	group, cat, ok := splitCategory(name)
+	if pattern, matched := firstMatch(s.incomeCategories, name); matched {
+		if ok {
+			name = cat
+		}
+		return "Income:" + s.segment(name), "income: category matches " + pattern
+	}
+	if ok {
+		return "Expenses:" + s.segment(group) + ":" + s.segment(cat), ""
+	}
+	return "Expenses:" + s.segment(name), ""
+}
+
+// equityPayeeNames returns the payees of the export whose rows belong to the
+// equity account.
+func (s *coaSuggester) equityPayeeNames() []string {
+	var names []string
+	for _, payee := range sortedKeys(s.scan.payees) {
+		if _, ok := firstMatch(s.equityPayees, payee); ok {
+			names = append(names, payee)
+		}
+	}
+	return names
+}
+
+// firstMatch returns the first of the patterns that matches s.
+func firstMatch(patterns []namePattern, s string) (string, bool) {
+	for _, p := range patterns {
+		if p.re.MatchString(s) {
+			return p.pattern, true
+		}
+	}
+	return "", false
+}
+
+// coa renders a complete mapping file for the export.
+func (s *coaSuggester) coa() string {
 	var sb strings.Builder
-	sb.WriteString("accounts:\n")
-	for _, acct := range accounts {
+	line := func(section, key, target, note string) {
+		sb.WriteString("  # " + s.usageComment(section, key) + "\n")
 		// Suggest a Ledger-style account name, but you can edit later
-		sb.WriteString(fmt.Sprintf("  \"%s\":    Assets:Bank:%s\n", acct, sanitizeLedgerName(acct)))
+		sb.WriteString(fmt.Sprintf("  %s:    %s", yamlQuote(key), yamlScalar(target)))
+		if note != "" {
+			sb.WriteString("  # " + note)
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("accounts:\n")
+	for _, acct := range s.scan.ordered("accounts", s.opts.Sort) {
+		target, note := s.account(acct)
+		line("accounts", acct, target, note)
 	}
 	sb.WriteString("  \"*\":    Assets:Unknown\n\n")
 	sb.WriteString("categories:\n")
-	for _, cat := range categories {
-		sb.WriteString(fmt.Sprintf("  \"%s\":    Expenses:%s\n", cat, sanitizeLedgerName(cat)))
+	for _, cat := range s.scan.ordered("categories", s.opts.Sort) {
+		target, note := s.category(cat)
+		line("categories", cat, target, note)
 	}
 	sb.WriteString("  \"*\":    Expenses:Unknown\n")
 
-	return os.WriteFile(yamlFile, []byte(sb.String()), 0644)
+	if payees := s.equityPayeeNames(); len(payees) > 0 {
+		sb.WriteString("\npayees:\n")
+		for _, payee := range payees {
+			sb.WriteString(fmt.Sprintf("  - match: %s\n    target: %s\n", yamlQuote(literalPattern(payee)), yamlScalar(s.opts.EquityAccount)))
+		}
+	}
+	return sb.String()
+}
+
+// usageComment describes how much a name is used in the export.
+func (s *coaSuggester) usageComment(section, name string) string {
+	return s.scan.usage(section, name).describe(s.scan.commodity)
 }
 
-func sanitizeLedgerName(s string) string {
-	// Replace spaces and special chars with colon/underscore for Ledger
-	s = strings.ReplaceAll(s, " ", "")
-	s = strings.ReplaceAll(s, "-", "")
-	s = strings.ReplaceAll(s, "(", "")
-	s = strings.ReplaceAll(s, ")", "")
-	s = strings.ReplaceAll(s, "/", "")
-	s = strings.ReplaceAll(s, "&", "And")
-	s = strings.ReplaceAll(s, ":", "")
-	return s
+// namingStyles are the accepted values of --naming.
+var namingStyles = []string{"spaces", "title", "kebab"}
+
+// segment turns a YNAB name into one segment of a Ledger account name in the
+// configured naming style. A name with nothing left after sanitising, such as
+// one made of emoji only, becomes "Unnamed".
+func (s *coaSuggester) segment(name string) string {
+	if seg := ledgerSegment(name, s.opts.Naming); seg != "" {
+		return seg
+	}
+	return ledgerSegment("Unnamed", s.opts.Naming)
 }
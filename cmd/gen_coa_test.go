@@ -0,0 +1,346 @@
+package cmd
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCOASuggestions(t *testing.T) {
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/01/2021","Starting Balance","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$500.00,"Cleared"
+"Checking","","01/02/2021","Employer","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$900.00,"Cleared"
+"Checking","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Citi Visa","","01/03/2021","Shop","Food: Groceries","Food","Groceries","",$50.00,$0.00,"Cleared"
+"Store Credit","","01/03/2021","Shop","Food: Groceries","Food","Groceries","",$50.00,$0.00,"Cleared"
+"Store Credit","","01/05/2021","Shop","Food: Groceries","Food","Groceries","",$10.00,$0.00,"Cleared"
+"Checking","","01/04/2021","Transfer : Car Loan","","","","",$100.00,$0.00,"Cleared"
+"Checking","","01/04/2021","Transfer : House","","","","",$100.00,$0.00,"Cleared"`
+
+	scan, err := scanRegister(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	suggest, err := newCOASuggester(defaultCOAOptions(), scan)
+	if err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+
+	expected := `accounts:
+  # 1 transaction, outflow $0.00, inflow $100.00, 2021-01-04 to 2021-01-04
+  "Car Loan":    Liabilities:Car Loan  # liability: name matches /(?i)(visa|amex|card|loan|mortgage)/; tracking account: only seen through transfers
+  # 5 transactions, outflow $205.00, inflow $1400.00, 2021-01-01 to 2021-01-04
+  "Checking":    Assets:Bank:Checking
+  # 1 transaction, outflow $50.00, inflow $0.00, 2021-01-03 to 2021-01-03
+  "Citi Visa":    Liabilities:Citi Visa  # liability: name matches /(?i)(visa|amex|card|loan|mortgage)/
+  # 1 transaction, outflow $0.00, inflow $100.00, 2021-01-04 to 2021-01-04
+  "House":    Assets:House  # tracking account: only seen through transfers
+  # 2 transactions, outflow $60.00, inflow $0.00, 2021-01-03 to 2021-01-05
+  "Store Credit":    Liabilities:Store Credit  # liability: balance negative on 100% of days
+  "*":    Assets:Unknown
+
+categories:
+  # 4 transactions, outflow $115.00, inflow $0.00, 2021-01-02 to 2021-01-05
+  "Food: Groceries":    Expenses:Food:Groceries
+  # 2 transactions, outflow $0.00, inflow $1400.00, 2021-01-01 to 2021-01-02
+  "Inflow: Ready to Assign":    Income:Ready to Assign  # income: category matches Inflow: *
+  "*":    Expenses:Unknown
+
+payees:
+  - match: "Starting Balance"
+    target: Equity:Opening Balances
+`
+	if got := suggest.coa(); got != expected {
+		t.Errorf("coa() =\n%s\nwant\n%s", got, expected)
+	}
+	if _, err := parseMapping([]byte(suggest.coa())); err != nil {
+		t.Errorf("generated mapping does not load: %v", err)
+	}
+
+	if got := strings.Join(scan.ordered("accounts", "volume"), ", "); got != "Checking, Car Loan, House, Store Credit, Citi Visa" {
+		t.Errorf("ordered(accounts, volume) = %s", got)
+	}
+	if got := strings.Join(scan.ordered("categories", "volume"), ", "); got != "Inflow: Ready to Assign, Food: Groceries" {
+		t.Errorf("ordered(categories, volume) = %s", got)
+	}
+
+	opts := defaultCOAOptions()
+	opts.LiabilityNames = []string{"*Credit"}
+	opts.NegativeShare = 0
+	if suggest, err = newCOASuggester(opts, scan); err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+	if got, _ := suggest.account("Citi Visa"); got != "Assets:Bank:Citi Visa" {
+		t.Errorf("account(Citi Visa) = %q with custom patterns", got)
+	}
+	if got, note := suggest.account("Store Credit"); got != "Liabilities:Store Credit" || note != "liability: name matches *Credit" {
+		t.Errorf("account(Store Credit) = %q (%s) with custom patterns", got, note)
+	}
+}
+
+func TestGenerateCOAQuotesNames(t *testing.T) {
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Joe's ""Fun"" Card","","01/02/2021","Shop","Kids\Teens: Toys #1","Kids\Teens","Toys #1","",$5.00,$0.00,"Cleared"
+"Joe's ""Fun"" Card","","01/04/2021","Cafe","Fun 🎉: Coffee","Fun 🎉","Coffee","",$3.00,$0.00,"Cleared"
+"Joe's ""Fun"" Card","","01/03/2021","Employer","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$50.00,"Cleared"`
+
+	scan, err := scanRegister(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	suggest, err := newCOASuggester(defaultCOAOptions(), scan)
+	if err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+	coa := suggest.coa()
+	for _, want := range []string{
+		`  "Joe's \"Fun\" Card":    `,
+		`  "Kids\\Teens: Toys #1":    `,
+		`  "Fun 🎉: Coffee":    Expenses:Fun:Coffee` + "\n",
+	} {
+		if !strings.Contains(coa, want) {
+			t.Errorf("coa() does not contain %s:\n%s", want, coa)
+		}
+	}
+
+	m, err := parseMapping([]byte(coa))
+	if err != nil {
+		t.Fatalf("generated mapping does not load: %v\n%s", err, coa)
+	}
+	if _, ok := m.Accounts[`Joe's "Fun" Card`]; !ok {
+		t.Errorf("generated mapping lacks the account key: %v", m.Accounts)
+	}
+	if _, ok := m.Categories["Fun 🎉: Coffee"]; !ok {
+		t.Errorf("generated mapping lacks the emoji category key: %v", m.Categories)
+	}
+	if _, ok := m.Categories[`Kids\Teens: Toys #1`]; !ok {
+		t.Errorf("generated mapping lacks the category key: %v", m.Categories)
+	}
+}
+
+func TestGenerateCOAEquityPayeePatterns(t *testing.T) {
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/01/2021","Cash*Back","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$10.00,"Cleared"
+"Checking","","01/01/2021","Transfer [Old]","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$20.00,"Cleared"
+"Checking","","01/02/2021","Cash Back","Fun: Stuff","Fun","Stuff","",$5.00,$0.00,"Cleared"
+"Checking","","01/02/2021","Cash*Back Plus","Fun: Stuff","Fun","Stuff","",$5.00,$0.00,"Cleared"
+"Checking","","01/02/2021","Transfer O","Fun: Stuff","Fun","Stuff","",$5.00,$0.00,"Cleared"`
+
+	scan, err := scanRegister(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	opts := defaultCOAOptions()
+	opts.EquityPayees = []string{`/^Cash\*Back$/`, "Transfer [Old]"}
+	suggest, err := newCOASuggester(opts, scan)
+	if err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+	coa := suggest.coa()
+	for _, want := range []string{
+		`  - match: "/^Cash\\*Back$/"`,
+		`  - match: "Transfer [Old]"`,
+	} {
+		if !strings.Contains(coa, want) {
+			t.Errorf("coa() does not contain %s:\n%s", want, coa)
+		}
+	}
+
+	// Each rule matches its own payee only
+	m, err := parseMapping([]byte(coa))
+	if err != nil {
+		t.Fatalf("generated mapping does not load: %v\n%s", err, coa)
+	}
+	for payee, want := range map[string]bool{"Cash*Back": true, "Transfer [Old]": true, "Cash Back": false, "Cash*Back Plus": false, "Transfer O": false} {
+		_, ok := m.matchPayeeTarget(ynabRow{Payee: payee})
+		if ok != want {
+			t.Errorf("payee rules match %q = %v, want %v", payee, ok, want)
+		}
+	}
+}
+
+func TestLedgerSegment(t *testing.T) {
+	tests := []struct {
+		name, style, want string
+	}{
+		{"Monthly Bills", "spaces", "Monthly Bills"},
+		{"Rent/Mortgage  (shared)", "spaces", "Rent/Mortgage shared"},
+		{"Misc: Other; Stuff", "spaces", "Misc Other Stuff"},
+		{"ready to assign", "title", "ReadyToAssign"},
+		{"Rent/Mortgage", "title", "RentMortgage"},
+		{"Kids & Pets", "title", "KidsAndPets"},
+		{"Kids & Pets", "kebab", "kids-and-pets"},
+		{"Auto Loan (2019)", "kebab", "auto-loan-2019"},
+	}
+	for _, tc := range tests {
+		if got := ledgerSegment(tc.name, tc.style); got != tc.want {
+			t.Errorf("ledgerSegment(%q, %q) = %q, want %q", tc.name, tc.style, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateCOACollisions(t *testing.T) {
+	csv := "\"Account\",\"Flag\",\"Date\",\"Payee\",\"Category Group/Category\",\"Category Group\",\"Category\",\"Memo\",\"Outflow\",\"Inflow\",\"Cleared\"\n" +
+		"\"Checking\",\"\",\"01/02/2021\",\"A\",\"Fun: 🎉 Parties\",\"Fun\",\"🎉 Parties\",\"\",$5.00,$0.00,\"Cleared\"\n" +
+		"\"Checking\",\"\",\"01/02/2021\",\"A\",\"Fun: Parties\",\"Fun\",\"Parties\",\"\",$5.00,$0.00,\"Cleared\"\n" +
+		"\"Checking\",\"\",\"01/02/2021\",\"A\",\"Fun: parties;\",\"Fun\",\"parties;\",\"\",$5.00,$0.00,\"Cleared\"\n" +
+		"\"Checking\",\"\",\"01/02/2021\",\"A\",\"Food: Caf\u00e9\",\"Food\",\"Caf\u00e9\",\"\",$5.00,$0.00,\"Cleared\"\n" +
+		"\"Checking\",\"\",\"01/02/2021\",\"A\",\"Food: Cafe\u0301\",\"Food\",\"Cafe\u0301\",\"\",$5.00,$0.00,\"Cleared\"\n" +
+		"\"Checking\",\"\",\"01/02/2021\",\"A\",\"Gifts: 🎁\",\"Gifts\",\"🎁\",\"\",$5.00,$0.00,\"Cleared\"\n"
+
+	scan, err := scanRegister(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	suggest, err := newCOASuggester(defaultCOAOptions(), scan)
+	if err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+
+	tests := []struct {
+		category, want string
+	}{
+		{"Fun: Parties", "Expenses:Fun:Parties"},
+		{"Fun: parties;", "Expenses:Fun:parties 2"},
+		{"Fun: 🎉 Parties", "Expenses:Fun:Parties 3"},
+		{"Food: Cafe\u0301", "Expenses:Food:Caf\u00e9"},
+		{"Food: Caf\u00e9", "Expenses:Food:Caf\u00e9 2"},
+		{"Gifts: 🎁", "Expenses:Gifts:Unnamed"},
+	}
+	for _, tc := range tests {
+		if got, _ := suggest.category(tc.category); got != tc.want {
+			t.Errorf("category(%q) = %q, want %q", tc.category, got, tc.want)
+		}
+	}
+
+	expected := []string{
+		"categories[\"Food: Cafe\u0301\"], categories[\"Food: Caf\u00e9\"] would all map to Expenses:Food:Caf\u00e9; numbering all but the first",
+		`categories["Fun: Parties"], categories["Fun: parties;"], categories["Fun: 🎉 Parties"] would all map to Expenses:Fun:Parties; numbering all but the first`,
+	}
+	if strings.Join(suggest.warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("warnings = %q, want %q", suggest.warnings, expected)
+	}
+}
+
+func TestGenerateCOALearnFrom(t *testing.T) {
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Checking","","01/02/2021","Cafe","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Checking","","01/03/2021","Grocer","Food: Groceries","Food","Groceries","",$7.00,$0.00,"Cleared"
+"Checking","","01/04/2021","Transfer : Savings","","","","",$100.00,$0.00,"Cleared"
+"Checking","","01/09/2021","Cinema","Fun: Movies","Fun","Movies","",$12.00,$0.00,"Cleared"`
+
+	journal := `; opening comment
+account Assets:Chase
+
+2021/01/02 * (101) Grocer Inc.  ; weekly shop
+    Expenses:Food               $5.00
+    Assets:Chase
+
+2021-01-02 Cafe
+    Expenses:Dining             $5.00  ; coffee
+    Assets:Chase               $-5.00
+
+2021/01/03=2021/01/04 ! GROCER
+    Expenses:Food       $7.00
+    [Budget:Food]      $-7.00
+    Assets:Chase
+
+2021/01/04 Savings
+    Assets:Savings    $100.00 = $100.00
+    Assets:Chase
+`
+	txns, err := readLedgerJournal(strings.NewReader(journal))
+	if err != nil {
+		t.Fatalf("readLedgerJournal() error = %v", err)
+	}
+	if len(txns) != 4 || txns[0].Payee != "Grocer Inc." || txns[0].Line != 4 || txns[0].Postings[1].Amount != -5000 {
+		t.Fatalf("readLedgerJournal() = %+v", txns)
+	}
+	if p := txns[2].Postings; p[1].Account != "Budget:Food" || !p[1].Virtual || p[2].Amount != -7000 {
+		t.Errorf("virtual posting read as %+v", p)
+	}
+
+	learned, err := learnMappings(strings.NewReader(csv), txns)
+	if err != nil {
+		t.Fatalf("learnMappings() error = %v", err)
+	}
+	if learned.matched != 4 || learned.rows != 5 {
+		t.Errorf("matched %d of %d rows, want 4 of 5", learned.matched, learned.rows)
+	}
+
+	scan, err := scanRegister(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("scanRegister() error = %v", err)
+	}
+	scan.learned = learned
+	suggest, err := newCOASuggester(defaultCOAOptions(), scan)
+	if err != nil {
+		t.Fatalf("newCOASuggester() error = %v", err)
+	}
+	for _, tc := range []struct {
+		section, name, target, note string
+	}{
+		{"accounts", "Checking", "Assets:Chase", "learned: 100% of 4 matched transactions"},
+		{"accounts", "Savings", "Assets:Savings", "learned: 100% of 1 matched transaction"},
+		{"categories", "Food: Groceries", "Expenses:Food", "learned: 66% of 3 matched transactions"},
+		{"categories", "Fun: Movies", "Expenses:Fun:Movies", ""},
+	} {
+		sg := suggest.suggestions[coaName{tc.section, tc.name}]
+		if sg.target != tc.target || sg.note != tc.note {
+			t.Errorf("%s[%q] = %q  # %q, want %q  # %q", tc.section, tc.name, sg.target, sg.note, tc.target, tc.note)
+		}
+	}
+}
+
+func TestReadLedgerJournalClearedPostings(t *testing.T) {
+	journal := `2021/01/02 Grocer
+    * Expenses:Food          $10.00
+    Assets:Checking
+
+2021/01/03 Pharmacy
+    ! Expenses:Health	$4.50  ; pending refund
+    * Assets:Checking
+`
+	txns, err := readLedgerJournal(strings.NewReader(journal))
+	if err != nil {
+		t.Fatalf("readLedgerJournal() error = %v", err)
+	}
+	want := [][]ledgerPosting{
+		{{Account: "Expenses:Food", Amount: 10000}, {Account: "Assets:Checking", Amount: -10000}},
+		{{Account: "Expenses:Health", Amount: 4500}, {Account: "Assets:Checking", Amount: -4500}},
+	}
+	if len(txns) != len(want) {
+		t.Fatalf("readLedgerJournal() = %+v", txns)
+	}
+	for i, txn := range txns {
+		if !slices.Equal(txn.Postings, want[i]) {
+			t.Errorf("transaction %d postings = %+v, want %+v", i+1, txn.Postings, want[i])
+		}
+	}
+}
+
+func TestSimilarPayee(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Grocer Inc.", "GROCER", true},
+		{"Shell Oil #123", "Shell", true},
+		{"Shellfish Co", "Shell", false},
+		{"The Corner Shop", "corner shop", true},
+		{"A", "A & W", false},
+		{"", "Grocer", false},
+	}
+	for _, tt := range tests {
+		if got := similarPayee(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarPayee(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	// A near miss does not make the choice ambiguous
+	candidates := []*ledgerTransaction{{Payee: "Shellfish Co"}, {Payee: "Shell Oil #12"}}
+	if got := pickTransaction(candidates, "Shell"); got != candidates[1] {
+		t.Errorf("pickTransaction(Shell) = %+v, want Shell Oil #12", got)
+	}
+}
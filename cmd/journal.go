@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// journalWriter receives the sorted entries of a conversion. Directives are
+// written before any entry.
+type journalWriter interface {
+	WriteDirective(line string) error
+	WriteEntry(e journalEntry) error
+	Close() error
+}
+
+// journalStream writes entries one after another to a single destination.
+type journalStream struct {
+	out    *bufio.Writer
+	closer io.Closer // nil when the destination is not owned by the stream
+	empty  bool
+}
+
+func newJournalStream(w io.Writer) *journalStream {
+	return &journalStream{out: bufio.NewWriter(w), empty: true}
+}
+
+// createJournalFile creates (or truncates) a journal file at path.
+func createJournalFile(path string) (*journalStream, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := newJournalStream(f)
+	s.closer = f
+	return s, nil
+}
+
+func (s *journalStream) WriteEntry(e journalEntry) error {
+	if !s.empty {
+		s.out.WriteString("\n")
+	}
+	s.empty = false
+	_, err := s.out.WriteString(e.Text)
+	return err
+}
+
+// WriteLine writes a line that is not a transaction, such as a directive.
+func (s *journalStream) WriteLine(line string) error {
+	_, err := s.out.WriteString(line + "\n")
+	return err
+}
+
+func (s *journalStream) WriteDirective(line string) error {
+	return s.WriteLine(line)
+}
+
+func (s *journalStream) Close() error {
+	err := s.out.Flush()
+	if s.closer != nil {
+		if cerr := s.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// renderEntry builds a generated transaction, such as an opening or closing
+// entry, from explicit postings. The balancing account takes the remainder
+// and is written without an amount.
+func renderEntry(date time.Time, payee string, postings []entryPosting, balancing, commodity string) journalEntry {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s", date.Format("2006/01/02"), payee)
+
+	var total int64
+	for _, p := range postings {
+		fmt.Fprintf(&sb, "\n    %s  %s", p.Account, formatAmount(p.Amount, commodity))
+		total += p.Amount
+	}
+	fmt.Fprintf(&sb, "\n    %s", balancing)
+
+	return journalEntry{
+		Date:      date,
+		Account:   balancing,
+		Commodity: commodity,
+		Postings:  append(append([]entryPosting(nil), postings...), entryPosting{Account: balancing, Amount: -total}),
+		Text:      sb.String(),
+	}
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ledgerMappingNotes are the notes of an account declaration that map YNAB
+// names to it. "ynab" puts the name in the accounts section when the
+// declared account is under Assets or Liabilities and in the categories
+// section otherwise; the other two choose the section explicitly.
+var ledgerMappingNotes = map[string]string{
+	"ynab":          "",
+	"ynab-account":  "accounts",
+	"ynab-category": "categories",
+}
+
+// parseLedgerMapping builds a mapping from the account declarations of a
+// Ledger file, such as
+//
+//	account Expenses:Food:Dining
+//	    ; ynab: Just for Fun: Dining Out
+//
+// Every note maps one YNAB name, which may be "*" for the catch-all, to the
+// declared account, and the entry's line is the note's. Anything else in
+// the file, including transactions, is ignored.
+func parseLedgerMapping(data []byte) (*Mapping, error) {
+	m := &Mapping{
+		Accounts:   make(map[string]MappingValue),
+		Categories: make(map[string]MappingValue),
+	}
+
+	var account string
+	lineNum := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" {
+			continue
+		}
+
+		var comment string
+		if line[0] == ' ' || line[0] == '\t' {
+			if account == "" {
+				continue
+			}
+			body := strings.TrimSpace(line)
+			if body[0] != ';' {
+				// Other sub-directives, such as alias and assert
+				continue
+			}
+			comment = body[1:]
+		} else {
+			account = ""
+			rest, ok := strings.CutPrefix(line, "account ")
+			if !ok {
+				continue
+			}
+			// A note may follow the declaration on the same line
+			rest, comment, _ = strings.Cut(rest, ";")
+			account = strings.TrimSpace(rest)
+			if i := strings.Index(account, "  "); i >= 0 {
+				account = account[:i]
+			}
+			if account == "" {
+				return nil, fmt.Errorf("line %d: account declaration without a name", lineNum)
+			}
+		}
+
+		key, name, ok := strings.Cut(strings.TrimSpace(comment), ":")
+		if !ok {
+			continue
+		}
+		section, isMapping := ledgerMappingNotes[strings.ToLower(strings.TrimSpace(key))]
+		if !isMapping {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("line %d: %s note without a YNAB name", lineNum, strings.TrimSpace(key))
+		}
+		if section == "" {
+			section = "categories"
+			if top, _, _ := strings.Cut(account, ":"); slices.Contains([]string{"Assets", "Liabilities"}, top) {
+				section = "accounts"
+			}
+		}
+
+		entries := m.Accounts
+		if section == "categories" {
+			entries = m.Categories
+		}
+		if existing, ok := entries[name]; ok {
+			return nil, fmt.Errorf("line %d: %s[%q] is already mapped to %s at line %d", lineNum, section, name, existing[0].Account, existing[0].Line)
+		}
+		entries[name] = MappingValue{{Account: account, Line: lineNum}}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := m.compile(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
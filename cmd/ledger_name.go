@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ledgerSignificant are the characters that mean something in a posting
+// line, such as the start of a comment, a cost or a virtual account, and so
+// are left out of suggested account names.
+const ledgerSignificant = "()[]{};@\"*=|#"
+
+// ledgerSegment turns a name into an account name segment. The name is
+// normalised to NFC, so that accented letters typed in different ways come
+// out the same, and emoji and other symbols are dropped. Colons would start a
+// new segment, runs of spaces end the account name in a posting, and the
+// ledgerSignificant characters have meanings of their own, so none of them
+// survive either. With the "title" and "kebab" styles the name is split into
+// words on anything that is not a letter or digit, with "&" read as "and".
+// The result may be empty when the name has no letters or digits.
+func ledgerSegment(name, style string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == ':' || unicode.IsSpace(r):
+			return ' '
+		case isEmojiOrSymbol(r), unicode.IsControl(r), strings.ContainsRune(ledgerSignificant, r):
+			return -1
+		}
+		return r
+	}, norm.NFC.String(name))
+
+	if style == "spaces" {
+		return strings.Join(strings.Fields(name), " ")
+	}
+
+	words := strings.FieldsFunc(strings.ReplaceAll(name, "&", " and "), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r)
+	})
+	for i, w := range words {
+		if style == "kebab" {
+			words[i] = strings.ToLower(w)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(w)
+		words[i] = string(unicode.ToUpper(r)) + w[size:]
+	}
+	if style == "kebab" {
+		return strings.Join(words, "-")
+	}
+	return strings.Join(words, "")
+}
+
+// isEmojiOrSymbol reports whether r is part of an emoji or a pictographic
+// symbol: the symbols themselves and skin tone modifiers, the enclosing
+// keycap, variation selectors, and the zero width joiner and tag characters
+// that glue emoji sequences together.
+func isEmojiOrSymbol(r rune) bool {
+	return unicode.In(r, unicode.So, unicode.Sk, unicode.Me, unicode.Cf, unicode.Co, unicode.Cs, unicode.Variation_Selector)
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ledgerTransaction is a transaction read from an existing Ledger journal.
+type ledgerTransaction struct {
+	Date     time.Time
+	Payee    string
+	Postings []ledgerPosting
+	Line     int
+}
+
+// ledgerPosting is one posting of a ledgerTransaction. A posting written
+// without an amount takes the remainder of the transaction.
+type ledgerPosting struct {
+	Account string
+	Amount  int64 // milliunits
+	// Virtual postings, written in brackets or parentheses, track
+	// budgets and the like rather than money
+	Virtual bool
+}
+
+// readLedgerJournal reads the transactions of a Ledger journal. Directives,
+// comments, and automated and periodic transactions are skipped, and so are
+// included files. Amounts are read without their commodity, so the journal
+// is expected to use a single currency.
+func readLedgerJournal(r io.Reader) ([]ledgerTransaction, error) {
+	var (
+		txns    []ledgerTransaction
+		cur     *ledgerTransaction
+		elided  = -1 // index of the posting without an amount
+		lineNum int
+	)
+	finish := func() {
+		if cur == nil {
+			return
+		}
+		if elided >= 0 {
+			// Virtual postings balance on their own, if at all
+			var total int64
+			for _, p := range cur.Postings {
+				if !p.Virtual {
+					total += p.Amount
+				}
+			}
+			cur.Postings[elided].Amount = -total
+		}
+		txns = append(txns, *cur)
+		cur, elided = nil, -1
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" {
+			finish()
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			finish()
+			if line[0] >= '0' && line[0] <= '9' {
+				txn, err := parseLedgerHeader(line)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNum, err)
+				}
+				txn.Line = lineNum
+				cur = &txn
+			}
+			continue
+		}
+
+		// Indented lines are postings or notes; the other comment characters
+		// only start a comment at the beginning of a line, and "*" or "!"
+		// here marks a cleared or pending posting
+		body := strings.TrimSpace(line)
+		if cur == nil || body[0] == ';' {
+			continue
+		}
+		posting, hasAmount, err := parseLedgerPosting(body)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if !hasAmount {
+			if elided >= 0 {
+				return nil, fmt.Errorf("line %d: more than one posting without an amount", lineNum)
+			}
+			elided = len(cur.Postings)
+		}
+		cur.Postings = append(cur.Postings, posting)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+	return txns, nil
+}
+
+// parseLedgerHeader reads the date and payee of a transaction's first line,
+// such as "2021/01/02 * (1042) Grocer  ; note".
+func parseLedgerHeader(line string) (ledgerTransaction, error) {
+	line, _, _ = strings.Cut(line, ";")
+	dateText, rest, _ := strings.Cut(line, " ")
+
+	// Only the primary date of "date=auxdate" matters
+	dateText, _, _ = strings.Cut(dateText, "=")
+	dateText = strings.NewReplacer("-", "/", ".", "/").Replace(dateText)
+	date, err := time.Parse("2006/1/2", dateText)
+	if err != nil {
+		return ledgerTransaction{}, fmt.Errorf("invalid transaction date %q", dateText)
+	}
+
+	payee := strings.TrimSpace(rest)
+	if strings.HasPrefix(payee, "*") || strings.HasPrefix(payee, "!") {
+		payee = strings.TrimSpace(payee[1:])
+	}
+	if strings.HasPrefix(payee, "(") {
+		if i := strings.Index(payee, ")"); i >= 0 {
+			payee = strings.TrimSpace(payee[i+1:])
+		}
+	}
+	return ledgerTransaction{Date: date, Payee: payee}, nil
+}
+
+// parseLedgerPosting reads the account and amount of a posting line, after
+// its cleared or pending mark if any. The account ends at a tab or at two
+// spaces; brackets of virtual accounts, costs, balance assertions and
+// comments are dropped.
+func parseLedgerPosting(body string) (posting ledgerPosting, hasAmount bool, err error) {
+	body, _, _ = strings.Cut(body, ";")
+	if body != "" && (body[0] == '*' || body[0] == '!') {
+		body = strings.TrimLeft(body[1:], " \t")
+	}
+
+	end := len(body)
+	if i := strings.Index(body, "  "); i >= 0 {
+		end = i
+	}
+	if i := strings.Index(body, "\t"); i >= 0 && i < end {
+		end = i
+	}
+	account := strings.TrimSpace(body[:end])
+	posting.Account = strings.Trim(account, "()[]")
+	posting.Virtual = posting.Account != account
+
+	amountText := strings.TrimSpace(body[end:])
+	amountText, _, _ = strings.Cut(amountText, "@")
+	amountText, _, _ = strings.Cut(amountText, "=")
+	amountText = strings.TrimSpace(amountText)
+	if amountText == "" {
+		return posting, false, nil
+	}
+	if posting.Amount, err = parseAmount(amountText); err != nil {
+		return ledgerPosting{}, false, err
+	}
+	return posting, true, nil
+}
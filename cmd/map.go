@@ -0,0 +1,487 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// mapSamples is how many rows are shown for each unmapped name.
+const mapSamples = 3
+
+// unmappedName is an account or category of an export that only the
+// catch-all or the default maps, with what it is used for.
+type unmappedName struct {
+	coaName
+	current string // the account it is mapped to now
+	usage   nameUsage
+	samples []ynabRow
+}
+
+// mapAnswer is a mapping chosen in the map command.
+type mapAnswer struct {
+	coaName
+	target string
+}
+
+// mapFile asks, for every name of a register export that the mapping file
+// leaves to its catch-all, which account it should map to, and adds the
+// answers to the mapping file.
+func mapFile(registerFile string) error {
+	if format := mappingFormat(mappingFile); format != "yaml" {
+		return fmt.Errorf("map can only add to a YAML mapping file, and %s is %s", mappingFile, format)
+	}
+	data, err := os.ReadFile(mappingFile)
+	if err != nil {
+		return err
+	}
+	mapping, err := parseMapping(data)
+	if err != nil {
+		return fmt.Errorf("error loading mapping: %s: %w", mappingFile, err)
+	}
+
+	file, err := os.Open(registerFile)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+	names, commodity, err := findUnmapped(mapping, file)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Printf("Every account and category of %s is mapped\n", registerFile)
+		return nil
+	}
+
+	var (
+		out    io.Writer = os.Stdout
+		prompt linePrompter
+	)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "")
+		defer term.Restore(fd, state)
+		out, prompt = t, &terminalPrompter{t: t}
+	} else {
+		prompt = &plainPrompter{in: bufio.NewScanner(os.Stdin), out: os.Stdout}
+	}
+
+	answers, err := askMappings(out, prompt, mapping, names, commodity)
+	if err != nil {
+		return err
+	}
+	if len(answers) == 0 {
+		fmt.Fprintln(out, "Nothing added")
+		return nil
+	}
+	updated, err := addMappings(data, answers)
+	if err != nil {
+		return fmt.Errorf("could not update %s: %w", mappingFile, err)
+	}
+	if err := os.WriteFile(mappingFile, updated, 0644); err != nil {
+		return err
+	}
+	entries := "1 entry"
+	if len(answers) != 1 {
+		entries = fmt.Sprintf("%d entries", len(answers))
+	}
+	fmt.Fprintf(out, "Added %s to %s\n", entries, mappingFile)
+	return nil
+}
+
+// findUnmapped maps every row of a register export and collects the names
+// that fall to a catch-all or the default, the accounts first, each ordered
+// by the money it moved, largest first. Excluded rows are skipped.
+func findUnmapped(m *Mapping, r io.Reader) ([]*unmappedName, string, error) {
+	rows, err := newRegisterReader(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	found := make(map[coaName]*unmappedName)
+	commodity := ""
+	sections := map[string]map[string]MappingValue{"accounts": m.Accounts, "categories": m.Categories}
+	record := func(name coaName, match mappingMatch, row ynabRow, outflow, inflow int64) {
+		// A key whose entries' conditions do not hold for the row is left
+		// alone, as a second key of the same name cannot be added
+		if _, ok := sections[name.section][name.name]; ok {
+			return
+		}
+		if _, ok := m.aliases[name.section][name.name]; ok {
+			return
+		}
+		u, ok := found[name]
+		if !ok {
+			u = &unmappedName{coaName: name, current: match.Account}
+			found[name] = u
+		}
+		date, _ := parseYNABDate(row.Date)
+		u.usage.add(date, outflow, inflow)
+		if len(u.samples) < mapSamples {
+			u.samples = append(u.samples, row)
+		}
+	}
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading row: %w", err)
+		}
+		if _, ok := m.excluded(row); ok {
+			continue
+		}
+		if commodity == "" {
+			commodity = amountCommodity(row.Outflow)
+		}
+		inflow, _ := parseAmount(row.Inflow)
+		outflow, _ := parseAmount(row.Outflow)
+
+		if match, ok := m.unmapped(accountSteps, row, "Assets:Unknown"); ok {
+			record(coaName{"accounts", row.Account}, match, row, outflow, inflow)
+		}
+		if other, ok := transferAccount(row.Payee); ok {
+			// The other account sees the row the other way round
+			if match, ok := m.unmapped(accountSteps, row.withAccount(other), "Assets:Unknown"); ok {
+				record(coaName{"accounts", other}, match, row, inflow, outflow)
+			}
+		} else if row.Category != "" {
+			if match, ok := m.unmapped(categorySteps, row, "Expenses:Unknown"); ok {
+				record(coaName{"categories", row.Category}, match, row, outflow, inflow)
+			}
+		}
+	}
+
+	names := make([]*unmappedName, 0, len(found))
+	for _, u := range found {
+		names = append(names, u)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if a.section != b.section {
+			return a.section == "accounts"
+		}
+		if a.usage.volume() != b.usage.volume() {
+			return a.usage.volume() > b.usage.volume()
+		}
+		return a.name < b.name
+	})
+	return names, commodity, nil
+}
+
+// unmapped resolves a side of a row and reports whether only the catch-all
+// or the fallback maps it.
+func (m *Mapping) unmapped(steps []mappingStep, row ynabRow, fallback string) (mappingMatch, bool) {
+	step := ""
+	match := m.resolve(steps, row, fallback, func(name string, _ mappingMatch, ok bool) {
+		if ok {
+			step = name
+		}
+	})
+	return match, step == "" || step == "catch-all"
+}
+
+// linePrompter reads the answers of the map command.
+type linePrompter interface {
+	// prompt shows a prompt and returns the line entered after it;
+	// candidates are offered for tab completion where supported.
+	prompt(prompt string, candidates []string) (string, error)
+}
+
+// terminalPrompter reads lines with editing and tab completion.
+type terminalPrompter struct {
+	t *term.Terminal
+}
+
+func (p *terminalPrompter) prompt(prompt string, candidates []string) (string, error) {
+	p.t.SetPrompt(prompt)
+	p.t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' || pos != len(line) {
+			return "", 0, false
+		}
+		completed := completeAccount(line, candidates)
+		return completed, len(completed), completed != line
+	}
+	return p.t.ReadLine()
+}
+
+// plainPrompter reads lines from a pipe or file, without completion.
+type plainPrompter struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+func (p *plainPrompter) prompt(prompt string, _ []string) (string, error) {
+	fmt.Fprint(p.out, prompt)
+	if !p.in.Scan() {
+		if err := p.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	fmt.Fprintln(p.out)
+	return p.in.Text(), nil
+}
+
+// askMappings shows each unmapped name with its usage and sample rows and
+// asks for its account: the number of a suggestion, an account name, an
+// empty line to skip the name or "q" to stop. Names are skipped when the
+// input ends.
+func askMappings(out io.Writer, in linePrompter, m *Mapping, names []*unmappedName, commodity string) ([]mapAnswer, error) {
+	var targets []string
+	for _, t := range m.targets() {
+		if !captureRefRe.MatchString(t.Account) && !strings.HasSuffix(t.Account, "*") {
+			targets = append(targets, t.Account)
+		}
+	}
+
+	var answers []mapAnswer
+	for i, u := range names {
+		fmt.Fprintf(out, "\n[%d/%d] %s[%q], now %s\n", i+1, len(names), u.section, u.name, u.current)
+		fmt.Fprintf(out, "  %s\n", u.usage.describe(commodity))
+		for _, row := range u.samples {
+			inflow, _ := parseAmount(row.Inflow)
+			outflow, _ := parseAmount(row.Outflow)
+			sample := fmt.Sprintf("  %s  %-30s %12s  %s", row.Date, row.Payee, formatAmount(inflow-outflow, commodity), row.Memo)
+			fmt.Fprintln(out, strings.TrimRight(sample, " "))
+		}
+		suggestions := suggestTargets(m, u.coaName, targets)
+		for j, s := range suggestions {
+			fmt.Fprintf(out, "  %d) %s\n", j+1, s)
+		}
+
+		for {
+			line, err := in.prompt("Account (number, name, empty to skip, q to stop): ", accountPrefixes(targets))
+			if err == io.EOF {
+				return answers, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				break
+			}
+			if line == "q" {
+				return answers, nil
+			}
+			target := line
+			if n, err := strconv.Atoi(line); err == nil {
+				if n < 1 || n > len(suggestions) {
+					fmt.Fprintf(out, "  no suggestion %d\n", n)
+					continue
+				}
+				target = suggestions[n-1]
+			}
+			if err := checkAccountName(target); err != nil {
+				fmt.Fprintf(out, "  %q: %v\n", target, err)
+				continue
+			}
+			answers = append(answers, mapAnswer{u.coaName, target})
+			targets = append(targets, target)
+			break
+		}
+	}
+	return answers, nil
+}
+
+// suggestTargets returns up to five accounts for a name: the account a
+// category's siblings in its group suggest, then the targets of the mapping
+// that share the most words with the name, allowing for abbreviations and
+// typos.
+func suggestTargets(m *Mapping, name coaName, targets []string) []string {
+	var suggestions []string
+	seen := make(map[string]bool)
+	add := func(target string) {
+		if !seen[target] && len(suggestions) < 5 {
+			seen[target] = true
+			suggestions = append(suggestions, target)
+		}
+	}
+
+	if group, cat, ok := splitCategory(name.name); ok && name.section == "categories" {
+		keys := sortedKeys(m.Categories)
+		for _, key := range keys {
+			g, sibling, ok := splitCategory(key)
+			if !ok || g != group {
+				continue
+			}
+			for _, e := range m.Categories[key] {
+				if parent, ok := strings.CutSuffix(e.Account, ":"+ledgerSegment(sibling, "spaces")); ok {
+					add(parent + ":" + ledgerSegment(cat, "spaces"))
+				}
+			}
+		}
+	}
+
+	words := fuzzyWords(name.name)
+	type scored struct {
+		target string
+		score  int
+	}
+	var ranked []scored
+	for _, target := range targets {
+		_, rest, _ := strings.Cut(target, ":")
+		if score := fuzzyScore(words, fuzzyWords(rest)); score > 0 {
+			ranked = append(ranked, scored{target, score})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].target < ranked[j].target
+	})
+	for _, r := range ranked {
+		add(r.target)
+	}
+	return suggestions
+}
+
+// fuzzyWords splits a name into lower-case words of letters and digits.
+func fuzzyWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// fuzzyScore rates how well the words of a target match those of a name:
+// 3 for each word found as is, 2 for one that abbreviates or is abbreviated
+// by a target word, and 1 for one a letter away from a target word.
+func fuzzyScore(name, target []string) int {
+	score := 0
+	for _, w := range name {
+		best := 0
+		for _, t := range target {
+			switch {
+			case w == t:
+				best = 3
+			case len(w) >= 3 && len(t) >= 3 && (strings.HasPrefix(w, t) || strings.HasPrefix(t, w)):
+				best = max(best, 2)
+			case len(w) >= 4 && editDistance(w, t) <= 1:
+				best = max(best, 1)
+			}
+		}
+		score += best
+	}
+	return score
+}
+
+// editDistance is the Levenshtein distance between two words.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+// accountPrefixes lists accounts and every parent account above them, which
+// are what tab completion offers.
+func accountPrefixes(targets []string) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, target := range targets {
+		parts := strings.Split(target, ":")
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], ":")
+			if i < len(parts)-1 {
+				prefix += ":"
+			}
+			if !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// completeAccount extends a partly typed account as far as the candidates
+// starting with it agree, ignoring case when none matches as typed.
+func completeAccount(line string, candidates []string) string {
+	var matches []string
+	for _, fold := range []bool{false, true} {
+		for _, c := range candidates {
+			if strings.HasPrefix(c, line) || fold && strings.HasPrefix(strings.ToLower(c), strings.ToLower(line)) {
+				matches = append(matches, c)
+			}
+		}
+		if len(matches) > 0 {
+			break
+		}
+	}
+	if len(matches) == 0 {
+		return line
+	}
+	common := matches[0]
+	for _, c := range matches[1:] {
+		for !strings.HasPrefix(c, common) {
+			_, size := utf8.DecodeLastRuneInString(common)
+			common = common[:len(common)-size]
+		}
+	}
+	if len(common) < len(line) {
+		return line
+	}
+	return common
+}
+
+// addMappings adds the answers of the map command to a mapping file as new
+// lines before the catch-all of their sections, leaving the rest of the
+// file as it is.
+func addMappings(data []byte, answers []mapAnswer) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	root, err := mappingRoot(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var inserts []sectionInsert
+	for _, section := range []string{"accounts", "categories"} {
+		insert := sectionInsert{section: section}
+		for _, a := range answers {
+			if a.section == section {
+				insert.lines = append(insert.lines, fmt.Sprintf("%s: %s", yamlQuote(a.name), yamlScalar(a.target)))
+			}
+		}
+		if len(insert.lines) > 0 {
+			inserts = append(inserts, insert)
+		}
+	}
+	return insertEntries(data, root, inserts)
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// scriptedPrompter answers prompts with fixed lines, then ends the input.
+type scriptedPrompter struct {
+	lines []string
+}
+
+func (p *scriptedPrompter) prompt(_ string, _ []string) (string, error) {
+	if len(p.lines) == 0 {
+		return "", io.EOF
+	}
+	line := p.lines[0]
+	p.lines = p.lines[1:]
+	return line, nil
+}
+
+func TestMapUnmappedNames(t *testing.T) {
+	coa := `# Mapping for the household
+accounts:
+  "Checking": Assets:Bank:Checking  # main account
+  "*": Assets:Unknown
+
+categories:
+  "Fun: Games": Expenses:Fun:Games
+  "Food: Groceries": Expenses:Food:Groceries
+  "Food: Restaurants":
+    - account: Expenses:Business:Meals
+      when: {payee: "Client*"}
+  "*": Expenses:Unknown
+`
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Cinema","Fun: Movies","Fun","Movies","popcorn",$12.00,$0.00,"Cleared"
+"Checking","","01/03/2021","Cinema","Fun: Movies","Fun","Movies","",$10.00,$0.00,"Cleared"
+"Checking","","01/04/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Checking","","01/05/2021","Diner","Food: Restaurants","Food","Restaurants","",$30.00,$0.00,"Cleared"
+"Checking","","01/06/2021","Transfer : Savings","","","","",$100.00,$0.00,"Cleared"
+"Checking","","01/07/2021","Pharmacy","Health: Medicin","Health","Medicin","",$8.00,$0.00,"Cleared"`
+
+	m, err := parseMapping([]byte(coa))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	names, commodity, err := findUnmapped(m, strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("findUnmapped() error = %v", err)
+	}
+	var got []string
+	for _, u := range names {
+		got = append(got, u.section+":"+u.name)
+	}
+	if want := "accounts:Savings, categories:Fun: Movies, categories:Health: Medicin"; strings.Join(got, ", ") != want {
+		t.Fatalf("findUnmapped() = %s, want %s", strings.Join(got, ", "), want)
+	}
+	if names[1].usage.count != 2 || len(names[1].samples) != 2 || names[1].current != "Expenses:Unknown" {
+		t.Errorf("Fun: Movies = %+v", names[1])
+	}
+
+	if s := suggestTargets(m, names[1].coaName, []string{"Expenses:Fun:Games", "Expenses:Food:Groceries", "Expenses:Health:Medicine"}); strings.Join(s, ", ") != "Expenses:Fun:Movies, Expenses:Fun:Games" {
+		t.Errorf("suggestTargets(Fun: Movies) = %v", s)
+	}
+	if s := suggestTargets(m, names[2].coaName, []string{"Expenses:Fun:Games", "Expenses:Health:Medicine"}); strings.Join(s, ", ") != "Expenses:Health:Medicine" {
+		t.Errorf("suggestTargets(Health: Medicin) = %v", s)
+	}
+
+	var out strings.Builder
+	answers, err := askMappings(&out, &scriptedPrompter{lines: []string{"Assets:Bank:Savings", "9", "Bad;Name", "1"}}, m, names, commodity)
+	if err != nil {
+		t.Fatalf("askMappings() error = %v", err)
+	}
+	for _, want := range []string{
+		`[2/3] categories["Fun: Movies"], now Expenses:Unknown`,
+		"  2 transactions, outflow $22.00, inflow $0.00, 2021-01-02 to 2021-01-03",
+		"  01/02/2021  Cinema                              $-12.00  popcorn",
+		"  1) Expenses:Fun:Movies",
+		"  no suggestion 9",
+		`  "Bad;Name": invalid character ';'`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if len(answers) != 2 || answers[0].target != "Assets:Bank:Savings" || answers[1].target != "Expenses:Fun:Movies" {
+		t.Fatalf("askMappings() = %+v", answers)
+	}
+
+	updated, err := addMappings([]byte(coa), answers)
+	if err != nil {
+		t.Fatalf("addMappings() error = %v", err)
+	}
+	// Only the new lines differ from the original file
+	expected := `# Mapping for the household
+accounts:
+  "Checking": Assets:Bank:Checking  # main account
+  "Savings": Assets:Bank:Savings
+  "*": Assets:Unknown
+
+categories:
+  "Fun: Games": Expenses:Fun:Games
+  "Food: Groceries": Expenses:Food:Groceries
+  "Food: Restaurants":
+    - account: Expenses:Business:Meals
+      when: {payee: "Client*"}
+  "Fun: Movies": Expenses:Fun:Movies
+  "*": Expenses:Unknown
+`
+	if string(updated) != expected {
+		t.Errorf("addMappings() =\n%s\nwant\n%s", updated, expected)
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(updated), "\n") {
+		if line != "  \"Savings\": Assets:Bank:Savings\n" && line != "  \"Fun: Movies\": Expenses:Fun:Movies\n" {
+			kept = append(kept, line)
+		}
+	}
+	if strings.Join(kept, "") != coa {
+		t.Errorf("addMappings() changed the existing lines:\n%s", strings.Join(kept, ""))
+	}
+}
+
+func TestCompleteAccount(t *testing.T) {
+	candidates := accountPrefixes([]string{"Expenses:Food:Groceries", "Expenses:Food:Dining", "Expenses:Fun", "Assets:Café"})
+	tests := []struct {
+		line, want string
+	}{
+		{"Ex", "Expenses:"},
+		{"Expenses:F", "Expenses:F"},
+		{"Expenses:Fo", "Expenses:Food:"},
+		{"expenses:food:g", "Expenses:Food:Groceries"},
+		{"Income", "Income"},
+		{"Assets:C", "Assets:Café"},
+	}
+	for _, tt := range tests {
+		if got := completeAccount(tt.line, candidates); got != tt.want {
+			t.Errorf("completeAccount(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,944 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Mapping maps YNAB accounts and categories to Ledger accounts, as read from
+// coa.yaml. A name is mapped by the first of these that applies:
+//
+//  1. a payee rule with a target (category side only)
+//  2. the entries of its exact key, in order
+//  3. the rules, in order
+//  4. its category group, keyed as "Group: *" or "Group" (category side only)
+//  5. the "*" catch-all
+//  6. Assets:Unknown or Expenses:Unknown
+type Mapping struct {
+	Accounts   map[string]MappingValue `yaml:"accounts"`
+	Categories map[string]MappingValue `yaml:"categories"`
+	Rules      []Rule                  `yaml:"rules"`
+	Payees     []PayeeRule             `yaml:"payees"`
+	Exclude    []Rule                  `yaml:"exclude"`
+
+	// aliases index the names listed in entries' aliases, by section
+	aliases map[string]map[string]string
+}
+
+// MappingValue is the value of a key in the accounts or categories section:
+// either a single Ledger account or a list of entries. The first entry whose
+// conditions hold for a row is used; when none holds, mapping falls through
+// to the rules.
+type MappingValue []MappingEntry
+
+// MappingEntry is one candidate Ledger account for a key, optionally limited
+// to rows from certain accounts or payees and to a date range. Aliases are
+// other YNAB names, such as the names an account had before it was renamed,
+// that map through this entry as well. Tags and metadata are added to the
+// postings the entry produces, and payee and commodity override the row's.
+// Ignore drops the rows the entry applies to from the journal instead. It is
+// written either as a plain account name or as an object:
+//
+//	"Groceries":
+//	  - account: Expenses:Business:Meals
+//	    when: {account: "Business*"}
+//	    tags: [deductible]
+//	  - Expenses:Food:Groceries
+type MappingEntry struct {
+	Account    string      `yaml:"account"`
+	When       MappingWhen `yaml:"when"`
+	dateBounds `yaml:",inline"`
+	Aliases    []string          `yaml:"aliases"`
+	Tags       []string          `yaml:"tags"`
+	Metadata   map[string]string `yaml:"metadata"`
+	Payee      string            `yaml:"payee"`
+	Commodity  string            `yaml:"commodity"`
+	Ignore     bool              `yaml:"ignore"`
+	Line       int               `yaml:"-"`
+}
+
+// MappingWhen holds the row conditions of a mapping entry, as glob or
+// /regex/ patterns matched against the YNAB account and payee.
+type MappingWhen struct {
+	Account string `yaml:"account"`
+	Payee   string `yaml:"payee"`
+
+	account *regexp.Regexp
+	payee   *regexp.Regexp
+}
+
+// mappingDate is a yyyy-mm-dd date in a mapping file.
+type mappingDate struct{ time.Time }
+
+// dateBounds limits a mapping entry or rule to the rows dated within a range.
+// Both ends are inclusive and optional.
+type dateBounds struct {
+	From  mappingDate `yaml:"from"`
+	Until mappingDate `yaml:"until"`
+}
+
+func (b dateBounds) bounded() bool {
+	return !b.From.IsZero() || !b.Until.IsZero()
+}
+
+func (b dateBounds) validate() error {
+	if !b.From.IsZero() && !b.Until.IsZero() && b.Until.Before(b.From.Time) {
+		return fmt.Errorf("until %s is before from %s", b.Until.Format(filterDateLayout), b.From.Format(filterDateLayout))
+	}
+	return nil
+}
+
+// contains reports whether a row falls within the bounds. A row with an
+// unparseable date never falls within a bounded range.
+func (b dateBounds) contains(row ynabRow) bool {
+	if !b.bounded() {
+		return true
+	}
+	date, err := parseYNABDate(row.Date)
+	if err != nil {
+		return false
+	}
+	if !b.From.IsZero() && date.Before(b.From.Time) {
+		return false
+	}
+	if !b.Until.IsZero() && date.After(b.Until.Time) {
+		return false
+	}
+	return true
+}
+
+func (b dateBounds) describe() []string {
+	var parts []string
+	if !b.From.IsZero() {
+		parts = append(parts, "from "+b.From.Format(filterDateLayout))
+	}
+	if !b.Until.IsZero() {
+		parts = append(parts, "until "+b.Until.Format(filterDateLayout))
+	}
+	return parts
+}
+
+func (d *mappingDate) UnmarshalYAML(node *yaml.Node) error {
+	t, err := time.Parse(filterDateLayout, node.Value)
+	if err != nil {
+		return &mappingError{Line: node.Line, Err: fmt.Errorf("invalid date %q (want yyyy-mm-dd)", node.Value)}
+	}
+	d.Time = t
+	return nil
+}
+
+// UnmarshalYAML accepts a single entry or a list of entries.
+func (v *MappingValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var entries []MappingEntry
+		if err := node.Decode(&entries); err != nil {
+			return err
+		}
+		*v = entries
+		return nil
+	}
+	var e MappingEntry
+	if err := node.Decode(&e); err != nil {
+		return err
+	}
+	*v = MappingValue{e}
+	return nil
+}
+
+// UnmarshalYAML accepts a plain account name or an entry object.
+func (e *MappingEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = MappingEntry{Account: node.Value, Line: node.Line}
+		return nil
+	}
+	type plain MappingEntry
+	if err := node.Decode((*plain)(e)); err != nil {
+		return err
+	}
+	e.Line = node.Line
+	if e.Account == "" && !e.Ignore {
+		return &mappingError{Line: node.Line, Err: fmt.Errorf("mapping entry has no account")}
+	}
+	return nil
+}
+
+func (e *MappingEntry) compile() error {
+	var err error
+	if e.When.Account != "" {
+		if e.When.account, err = compilePattern(e.When.Account); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", e.When.Account, err)
+		}
+	}
+	if e.When.Payee != "" {
+		if e.When.payee, err = compilePattern(e.When.Payee); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", e.When.Payee, err)
+		}
+	}
+	for _, tag := range e.Tags {
+		if !validTagName(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	for _, key := range e.metadataKeys() {
+		if !validTagName(key) {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+		// A line break would end the comment and start a posting
+		if strings.ContainsAny(e.Metadata[key], "\r\n") {
+			return fmt.Errorf("invalid metadata value %q for %s: line breaks are not allowed", e.Metadata[key], key)
+		}
+	}
+	if strings.TrimSpace(e.Payee) != e.Payee || strings.ContainsAny(e.Payee, "\n;") {
+		return fmt.Errorf("invalid payee %q", e.Payee)
+	}
+	if e.Commodity != "" && !validCommodity(e.Commodity) {
+		return fmt.Errorf("invalid commodity %q", e.Commodity)
+	}
+	return e.dateBounds.validate()
+}
+
+// validTagName reports whether a tag or metadata key can be written in a
+// Ledger comment, which rules out empty names, colons and whitespace.
+func validTagName(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+		return r == ':' || unicode.IsSpace(r)
+	})
+}
+
+// validCommodity reports whether a commodity can be written unquoted after
+// or before an amount.
+func validCommodity(commodity string) bool {
+	return !strings.ContainsFunc(commodity, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune(".,-+*/=<>()[]{}@;\"", r)
+	})
+}
+
+// comments renders the entry's tags and metadata as posting comments, with
+// metadata keys in sorted order.
+func (e *MappingEntry) comments() string {
+	var sb strings.Builder
+	if len(e.Tags) > 0 {
+		sb.WriteString("\n    ; :" + strings.Join(e.Tags, ":") + ":")
+	}
+	for _, key := range e.metadataKeys() {
+		fmt.Fprintf(&sb, "\n    ; %s: %s", key, e.Metadata[key])
+	}
+	return sb.String()
+}
+
+// metadataKeys returns the keys of the entry's metadata in sorted order.
+func (e *MappingEntry) metadataKeys() []string {
+	keys := make([]string, 0, len(e.Metadata))
+	for key := range e.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// conditional reports whether the entry only applies to some rows.
+func (e *MappingEntry) conditional() bool {
+	return e.When.Account != "" || e.When.Payee != "" || e.bounded()
+}
+
+// applies reports whether the entry's conditions hold for a row. A row with
+// an unparseable date never satisfies a date range.
+func (e *MappingEntry) applies(row ynabRow) bool {
+	if e.When.account != nil && !e.When.account.MatchString(row.Account) {
+		return false
+	}
+	if e.When.payee != nil && !e.When.payee.MatchString(row.Payee) {
+		return false
+	}
+	return e.contains(row)
+}
+
+// describe summarises the entry's conditions for explanations.
+func (e *MappingEntry) describe() string {
+	var parts []string
+	if e.When.Account != "" {
+		parts = append(parts, "account "+e.When.Account)
+	}
+	if e.When.Payee != "" {
+		parts = append(parts, "payee "+e.When.Payee)
+	}
+	parts = append(parts, e.dateBounds.describe()...)
+	return strings.Join(parts, ", ")
+}
+
+// Rule maps the rows whose fields match every given pattern to Target.
+// Patterns are globs, or regular expressions when written as /.../. The text
+// captured by each * or ? of a glob, or each group of a regular expression,
+// can be used in Target as $1, $2, ... in the order category, account,
+// payee, memo.
+type Rule struct {
+	Category string `yaml:"category"`
+	Account  string `yaml:"account"`
+	Payee    string `yaml:"payee"`
+	Memo     string `yaml:"memo"`
+	Apply    string `yaml:"apply"` // "category" (default) or "account"
+	Target   string `yaml:"target"`
+	Line     int    `yaml:"-"` // line of the rule in the mapping file
+
+	dateBounds `yaml:",inline"`
+
+	patterns []rulePattern
+}
+
+type rulePattern struct {
+	field func(ynabRow) string
+	re    *regexp.Regexp
+}
+
+// UnmarshalYAML records the line a rule starts on.
+func (r *Rule) UnmarshalYAML(node *yaml.Node) error {
+	type plain Rule
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	r.Line = node.Line
+	return nil
+}
+
+// PayeeRule applies to the rows whose payee matches Match, a glob or /regular
+// expression/, and whose category matches Category when one is given. Name
+// rewrites the payee to a canonical name; Target maps the category side,
+// taking precedence over the categories and rules sections. Both may use
+// $1, $2, ... like a Rule target, numbered payee first. Category restricts
+// Name as well as Target, so a rule that should rename a payee in every
+// category and map it in only some takes two entries.
+type PayeeRule struct {
+	Match    string `yaml:"match"`
+	Category string `yaml:"category"`
+	Name     string `yaml:"name"`
+	Target   string `yaml:"target"`
+	Line     int    `yaml:"-"`
+
+	dateBounds `yaml:",inline"`
+
+	re         *regexp.Regexp
+	categoryRe *regexp.Regexp
+}
+
+// UnmarshalYAML records the line a payee rule starts on.
+func (p *PayeeRule) UnmarshalYAML(node *yaml.Node) error {
+	type plain PayeeRule
+	if err := node.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	p.Line = node.Line
+	return nil
+}
+
+// loadMapping reads a mapping file in the format its extension names: YAML,
+// JSON, TOML, or a Ledger file whose account declarations carry the mapping
+// as notes. Errors name the file.
+func loadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m *Mapping
+	if mappingFormat(path) == "ledger" {
+		m, err = parseLedgerMapping(data)
+	} else {
+		var doc *yaml.Node
+		if doc, err = parseMappingDocument(path, data); err == nil {
+			m, err = decodeMapping(doc)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// mappingFormat returns the format of a mapping file by its extension:
+// json, toml, ledger, or yaml for anything else.
+func mappingFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	case ".ledger", ".journal":
+		return "ledger"
+	}
+	return "yaml"
+}
+
+// parseMappingDocument parses a YAML, JSON or TOML mapping file into a YAML
+// node tree, which keeps the line of every key and value. JSON is read by
+// the YAML parser, as YAML is a superset of it.
+func parseMappingDocument(path string, data []byte) (*yaml.Node, error) {
+	if mappingFormat(path) == "toml" {
+		return parseTOML(data)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// parseMapping decodes a YAML mapping file and compiles its patterns.
+func parseMapping(data []byte) (*Mapping, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return decodeMapping(&doc)
+}
+
+// mappingError is a mistake in a mapping file, at a line and, once known, in
+// the value of a key such as accounts["Checking"] or rules[2].
+type mappingError struct {
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *mappingError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s: %v", e.Line, e.Key, e.Err)
+}
+
+func (e *mappingError) Unwrap() error {
+	return e.Err
+}
+
+// yamlErrorRe splits the messages of a yaml.TypeError.
+var yamlErrorRe = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// keyError attributes an error in the value of a key to that key, at the
+// line of the error itself when it has one.
+func keyError(line int, key string, err error) error {
+	var me *mappingError
+	if errors.As(err, &me) && me.Key == "" {
+		line, err = me.Line, me.Err
+	}
+	var te *yaml.TypeError
+	if errors.As(err, &te) && len(te.Errors) > 0 {
+		if m := yamlErrorRe.FindStringSubmatch(te.Errors[0]); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			err = errors.New(m[2])
+		}
+	}
+	return &mappingError{Line: line, Key: key, Err: err}
+}
+
+// decodeMapping decodes a parsed mapping file section by section, so that
+// errors name the key they are found under, and compiles its patterns.
+// Unknown top-level keys are left to validate-mapping.
+func decodeMapping(doc *yaml.Node) (*Mapping, error) {
+	m := &Mapping{}
+	if len(doc.Content) > 0 {
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, &mappingError{Line: root.Line, Err: errors.New("mapping file is not a mapping")}
+		}
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key, value := root.Content[i], root.Content[i+1]
+			if value.Tag == "!!null" {
+				continue
+			}
+			var err error
+			switch key.Value {
+			case "accounts":
+				m.Accounts, err = decodeMappingSection(key.Value, value)
+			case "categories":
+				m.Categories, err = decodeMappingSection(key.Value, value)
+			case "rules":
+				m.Rules, err = decodeMappingList[Rule](key.Value, value)
+			case "payees":
+				m.Payees, err = decodeMappingList[PayeeRule](key.Value, value)
+			case "exclude":
+				m.Exclude, err = decodeMappingList[Rule](key.Value, value)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := m.compile(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeMappingSection decodes the accounts or categories section.
+func decodeMappingSection(name string, node *yaml.Node) (map[string]MappingValue, error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, &mappingError{Line: node.Line, Key: name, Err: errors.New("not a mapping")}
+	}
+	section := make(map[string]MappingValue, len(node.Content)/2)
+	lines := make(map[string]int, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		where := fmt.Sprintf("%s[%q]", name, key.Value)
+		if line, ok := lines[key.Value]; ok {
+			return nil, &mappingError{Line: key.Line, Key: where, Err: fmt.Errorf("defined twice, first at line %d", line)}
+		}
+		lines[key.Value] = key.Line
+
+		var v MappingValue
+		if err := value.Decode(&v); err != nil {
+			return nil, keyError(value.Line, where, err)
+		}
+		section[key.Value] = v
+	}
+	return section, nil
+}
+
+// decodeMappingList decodes the rules, payees or exclude section.
+func decodeMappingList[T any](name string, node *yaml.Node) ([]T, error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.SequenceNode {
+		return nil, &mappingError{Line: node.Line, Key: name, Err: errors.New("not a list")}
+	}
+	list := make([]T, len(node.Content))
+	for i, item := range node.Content {
+		if err := item.Decode(&list[i]); err != nil {
+			return nil, keyError(item.Line, fmt.Sprintf("%s[%d]", name, i+1), err)
+		}
+	}
+	return list, nil
+}
+
+// compile compiles the patterns of a decoded mapping, checks its entries and
+// rules, and indexes its aliases.
+func (m *Mapping) compile() error {
+	m.aliases = map[string]map[string]string{"accounts": {}, "categories": {}}
+	for name, section := range map[string]map[string]MappingValue{"accounts": m.Accounts, "categories": m.Categories} {
+		for key, value := range section {
+			for i := range value {
+				e := &value[i]
+				where := fmt.Sprintf("%s[%q]", name, key)
+				if len(value) > 1 {
+					where += fmt.Sprintf(" entry %d", i+1)
+				}
+				if err := e.compile(); err != nil {
+					return &mappingError{Line: e.Line, Key: where, Err: err}
+				}
+				for _, alias := range e.Aliases {
+					if _, ok := section[alias]; ok {
+						return &mappingError{Line: e.Line, Key: where, Err: fmt.Errorf("alias %q is also a key in %s", alias, name)}
+					}
+					if other, ok := m.aliases[name][alias]; ok && other != key {
+						return &mappingError{Line: e.Line, Key: where, Err: fmt.Errorf("alias %q is also listed under %q", alias, other)}
+					}
+					m.aliases[name][alias] = key
+				}
+			}
+		}
+	}
+	for i := range m.Rules {
+		if err := m.Rules[i].compile(); err != nil {
+			return &mappingError{Line: m.Rules[i].Line, Key: fmt.Sprintf("rules[%d]", i+1), Err: err}
+		}
+	}
+	for i := range m.Payees {
+		if err := m.Payees[i].compile(); err != nil {
+			return &mappingError{Line: m.Payees[i].Line, Key: fmt.Sprintf("payees[%d]", i+1), Err: err}
+		}
+	}
+	for i := range m.Exclude {
+		if err := m.Exclude[i].compileExclude(); err != nil {
+			return &mappingError{Line: m.Exclude[i].Line, Key: fmt.Sprintf("exclude[%d]", i+1), Err: err}
+		}
+	}
+	return nil
+}
+
+func (p *PayeeRule) compile() error {
+	if p.Match == "" {
+		return fmt.Errorf("missing match")
+	}
+	if p.Name == "" && p.Target == "" {
+		return fmt.Errorf("needs a name, a target or both")
+	}
+	var err error
+	if p.re, err = compilePattern(p.Match); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", p.Match, err)
+	}
+	if p.Category != "" {
+		if p.categoryRe, err = compilePattern(p.Category); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p.Category, err)
+		}
+	}
+	return p.dateBounds.validate()
+}
+
+// match reports whether the rule applies to the row, and returns the
+// captured text. Transfers never match, as their payee names the other
+// account.
+func (p *PayeeRule) match(row ynabRow) ([]string, bool) {
+	if p.re == nil || !p.contains(row) {
+		return nil, false
+	}
+	if _, ok := transferAccount(row.Payee); ok {
+		return nil, false
+	}
+	m := p.re.FindStringSubmatch(row.Payee)
+	if m == nil {
+		return nil, false
+	}
+	captures := m[1:]
+	if p.categoryRe != nil {
+		cm := p.categoryRe.FindStringSubmatch(row.Category)
+		if cm == nil {
+			return nil, false
+		}
+		captures = append(captures, cm[1:]...)
+	}
+	return captures, true
+}
+
+func (r *Rule) compile() error {
+	switch r.Apply {
+	case "":
+		r.Apply = "category"
+	case "category", "account":
+	default:
+		return fmt.Errorf("invalid apply %q (want category or account)", r.Apply)
+	}
+	if r.Target == "" {
+		return fmt.Errorf("missing target")
+	}
+	return r.compilePatterns()
+}
+
+// compileExclude compiles a rule of the exclude section, which drops the rows
+// it matches and so takes no target.
+func (r *Rule) compileExclude() error {
+	if r.Target != "" || r.Apply != "" {
+		return fmt.Errorf("exclude rules take no target or apply")
+	}
+	return r.compilePatterns()
+}
+
+func (r *Rule) compilePatterns() error {
+	fields := []struct {
+		pattern string
+		field   func(ynabRow) string
+	}{
+		{r.Category, func(row ynabRow) string { return row.Category }},
+		{r.Account, func(row ynabRow) string { return row.Account }},
+		{r.Payee, func(row ynabRow) string { return row.Payee }},
+		{r.Memo, func(row ynabRow) string { return row.Memo }},
+	}
+	r.patterns = nil
+	for _, f := range fields {
+		if f.pattern == "" {
+			continue
+		}
+		re, err := compilePattern(f.pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", f.pattern, err)
+		}
+		r.patterns = append(r.patterns, rulePattern{field: f.field, re: re})
+	}
+	if len(r.patterns) == 0 {
+		return fmt.Errorf("rule must match on at least one of category, account, payee or memo")
+	}
+	return r.dateBounds.validate()
+}
+
+// compilePattern compiles a /regular expression/ or a glob.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	return compileGlob(pattern)
+}
+
+// literalPattern returns a pattern that matches s and nothing else: s itself
+// when it has no glob wildcards and does not read as a /regex/, and an
+// anchored regular expression quoting it otherwise.
+func literalPattern(s string) string {
+	if !strings.ContainsAny(s, "*?") && !(len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")) {
+		return s
+	}
+	return "/^" + regexp.QuoteMeta(s) + "$/"
+}
+
+// match reports whether every pattern of the rule matches the row, and
+// returns the captured text.
+func (r *Rule) match(row ynabRow) ([]string, bool) {
+	if len(r.patterns) == 0 || !r.contains(row) {
+		return nil, false
+	}
+	var captures []string
+	for _, p := range r.patterns {
+		m := p.re.FindStringSubmatch(p.field(row))
+		if m == nil {
+			return nil, false
+		}
+		captures = append(captures, m[1:]...)
+	}
+	return captures, true
+}
+
+var captureRefRe = regexp.MustCompile(`\$\{(\d+)\}|\$(\d+)`)
+
+// expandTarget replaces $n and ${n} in a rule target with captured text.
+func expandTarget(target string, captures []string) string {
+	return captureRefRe.ReplaceAllStringFunc(target, func(ref string) string {
+		n, _ := strconv.Atoi(strings.Trim(ref, "${}"))
+		if n < 1 || n > len(captures) {
+			return ""
+		}
+		return captures[n-1]
+	})
+}
+
+// mappingMatch is the outcome of mapping a name: the Ledger account and a
+// description of the entry or rule that produced it.
+type mappingMatch struct {
+	Account string
+	Source  string        // e.g. categories["Groceries"] entry 2, rules[3]
+	Line    int           // line in the mapping file, 0 for built-in defaults
+	Entry   *MappingEntry // the entry that matched, nil for rules and defaults
+	Ref     mappingRef    // the entry or rule that matched, zero for defaults
+}
+
+// mappingRef identifies an entry or rule of a mapping: the section, the key
+// for accounts and categories, and the index of the entry in the key's value
+// or of the rule in its section.
+type mappingRef struct {
+	Section string
+	Key     string
+	Index   int
+}
+
+// String describes where a mapping came from, for annotations.
+func (m mappingMatch) String() string {
+	if m.Line == 0 {
+		return m.Source
+	}
+	return fmt.Sprintf("%s (line %d)", m.Source, m.Line)
+}
+
+// lookupKey returns the first entry of a key in a section that applies to the
+// row. A name that is not a key is looked up through the entries listing it
+// among their aliases.
+func (m *Mapping) lookupKey(section, key string, row ynabRow) (mappingMatch, bool) {
+	values := m.Accounts
+	if section == "categories" {
+		values = m.Categories
+	}
+
+	alias := ""
+	value, ok := values[key]
+	if !ok {
+		canonical, ok := m.aliases[section][key]
+		if !ok {
+			return mappingMatch{}, false
+		}
+		alias, key, value = key, canonical, values[canonical]
+	}
+
+	for i := range value {
+		e := &value[i]
+		if alias != "" && !slices.Contains(e.Aliases, alias) {
+			continue
+		}
+		if !e.applies(row) {
+			continue
+		}
+		source := fmt.Sprintf("%s[%q]", section, key)
+		if len(value) > 1 {
+			source += fmt.Sprintf(" entry %d", i+1)
+		}
+		if alias != "" {
+			source += fmt.Sprintf(" via alias %q", alias)
+		}
+		if e.conditional() {
+			source += " when " + e.describe()
+		}
+		return mappingMatch{Account: e.Account, Source: source, Line: e.Line, Entry: e, Ref: mappingRef{section, key, i}}, true
+	}
+	return mappingMatch{}, false
+}
+
+// matchRule returns the target of the first rule for the given side that
+// matches the row.
+func (m *Mapping) matchRule(apply string, row ynabRow) (mappingMatch, bool) {
+	for i := range m.Rules {
+		r := &m.Rules[i]
+		if r.Apply != apply {
+			continue
+		}
+		if captures, ok := r.match(row); ok {
+			return mappingMatch{
+				Account: expandTarget(r.Target, captures),
+				Source:  fmt.Sprintf("rules[%d]", i+1),
+				Line:    r.Line,
+				Ref:     mappingRef{Section: "rules", Index: i},
+			}, true
+		}
+	}
+	return mappingMatch{}, false
+}
+
+// mappingStep is one stage of resolving an account or category name.
+type mappingStep struct {
+	name string
+	try  func(m *Mapping, row ynabRow) (mappingMatch, bool)
+}
+
+// accountSteps and categorySteps list the stages of the two sides of a row
+// in order of precedence.
+var (
+	accountSteps = []mappingStep{
+		{"exact key", func(m *Mapping, row ynabRow) (mappingMatch, bool) {
+			return m.lookupKey("accounts", row.Account, row)
+		}},
+		{"account rules", func(m *Mapping, row ynabRow) (mappingMatch, bool) {
+			return m.matchRule("account", row)
+		}},
+		{"catch-all", func(m *Mapping, row ynabRow) (mappingMatch, bool) {
+			return m.lookupKey("accounts", "*", row)
+		}},
+	}
+	categorySteps = []mappingStep{
+		{"payee targets", (*Mapping).matchPayeeTarget},
+		{"exact key", func(m *Mapping, row ynabRow) (mappingMatch, bool) {
+			return m.lookupKey("categories", row.Category, row)
+		}},
+		{"category rules", func(m *Mapping, row ynabRow) (mappingMatch, bool) {
+			return m.matchRule("category", row)
+		}},
+		{"category group", mapGroup},
+		{"catch-all", func(m *Mapping, row ynabRow) (mappingMatch, bool) {
+			return m.lookupKey("categories", "*", row)
+		}},
+	}
+)
+
+// resolve runs the steps in order and returns the first match, or the
+// fallback account. trace, when not nil, is called with the outcome of every
+// step tried.
+func (m *Mapping) resolve(steps []mappingStep, row ynabRow, fallback string, trace func(step string, match mappingMatch, ok bool)) mappingMatch {
+	for _, step := range steps {
+		match, ok := step.try(m, row)
+		if trace != nil {
+			trace(step.name, match, ok)
+		}
+		if ok {
+			return match
+		}
+	}
+	return mappingMatch{Account: fallback, Source: "default"}
+}
+
+// resolveAccount maps the account side of a row.
+func resolveAccount(mapping *Mapping, row ynabRow) mappingMatch {
+	return mapping.resolve(accountSteps, row, "Assets:Unknown", nil)
+}
+
+// resolveCategory maps the category side of a row.
+func resolveCategory(mapping *Mapping, row ynabRow) mappingMatch {
+	return mapping.resolve(categorySteps, row, "Expenses:Unknown", nil)
+}
+
+func mapAccount(mapping *Mapping, row ynabRow) string {
+	return resolveAccount(mapping, row).Account
+}
+
+func mapCategory(mapping *Mapping, row ynabRow) string {
+	return resolveCategory(mapping, row).Account
+}
+
+// mapPayee returns the canonical name of a payee from the first matching
+// payee rule with a name, or the payee unchanged.
+func mapPayee(mapping *Mapping, row ynabRow) string {
+	if m, ok := mapping.matchPayeeName(row); ok {
+		return m.Account
+	}
+	return row.Payee
+}
+
+// matchPayeeName returns the canonical name given by the first matching
+// payee rule with a name, in place of an account.
+func (m *Mapping) matchPayeeName(row ynabRow) (mappingMatch, bool) {
+	for i := range m.Payees {
+		p := &m.Payees[i]
+		if p.Name == "" {
+			continue
+		}
+		if captures, ok := p.match(row); ok {
+			return mappingMatch{
+				Account: expandTarget(p.Name, captures),
+				Source:  fmt.Sprintf("payees[%d]", i+1),
+				Line:    p.Line,
+				Ref:     mappingRef{Section: "payees", Index: i},
+			}, true
+		}
+	}
+	return mappingMatch{}, false
+}
+
+// matchPayeeTarget returns the target of the first matching payee rule with
+// a target.
+func (m *Mapping) matchPayeeTarget(row ynabRow) (mappingMatch, bool) {
+	for i := range m.Payees {
+		p := &m.Payees[i]
+		if p.Target == "" {
+			continue
+		}
+		if captures, ok := p.match(row); ok {
+			return mappingMatch{
+				Account: expandTarget(p.Target, captures),
+				Source:  fmt.Sprintf("payees[%d]", i+1),
+				Line:    p.Line,
+				Ref:     mappingRef{Section: "payees", Index: i},
+			}, true
+		}
+	}
+	return mappingMatch{}, false
+}
+
+// splitCategory splits a YNAB "Group: Category" name into its parts.
+func splitCategory(category string) (group, name string, ok bool) {
+	return strings.Cut(category, ": ")
+}
+
+// mapGroup looks up the category group of a row's "Group: Category" name. A
+// target ending in ":*" has the category name appended in place of the "*",
+// so that "Monthly Bills": Expenses:Bills:* maps "Monthly Bills: Internet" to
+// Expenses:Bills:Internet.
+func mapGroup(mapping *Mapping, row ynabRow) (mappingMatch, bool) {
+	group, name, ok := splitCategory(row.Category)
+	if !ok {
+		return mappingMatch{}, false
+	}
+	m, ok := mapping.lookupKey("categories", group+": *", row)
+	if !ok {
+		if m, ok = mapping.lookupKey("categories", group, row); !ok {
+			return mappingMatch{}, false
+		}
+	}
+	if strings.HasSuffix(m.Account, ":*") {
+		m.Account = strings.TrimSuffix(m.Account, "*") + name
+	}
+	return m, true
+}
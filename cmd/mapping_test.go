@@ -0,0 +1,461 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMappingRules(t *testing.T) {
+	m, err := parseMapping([]byte(`
+accounts:
+  "Chase Checking": Assets:Bank:Chase
+  "*": Assets:Unknown
+categories:
+  "Bills: Phone": Expenses:Phone
+  "*": Expenses:Unknown
+rules:
+  - category: "Bills: Electric"
+    target: Expenses:Utilities
+  - category: "/^Bills: (.*)$/"
+    target: Expenses:Bills:$1
+  - payee: "*Coffee*"
+    memo: "work"
+    target: Expenses:Business:Meals
+  - account: "Chase *"
+    apply: account
+    target: Assets:Bank:Chase:${1}
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+	if m.Rules[1].Line != 11 {
+		t.Errorf("rule line = %d, want 11", m.Rules[1].Line)
+	}
+
+	tests := []struct {
+		name     string
+		row      ynabRow
+		account  string
+		category string
+	}{
+		{"exact keys win", ynabRow{Account: "Chase Checking", Category: "Bills: Phone"}, "Assets:Bank:Chase", "Expenses:Phone"},
+		{"first match wins", ynabRow{Account: "Chase Savings", Category: "Bills: Electric"}, "Assets:Bank:Chase:Savings", "Expenses:Utilities"},
+		{"regex capture", ynabRow{Category: "Bills: Water"}, "Assets:Unknown", "Expenses:Bills:Water"},
+		{"all patterns must match", ynabRow{Category: "Fun: Coffee", Payee: "Blue Coffee Co", Memo: "personal"}, "Assets:Unknown", "Expenses:Unknown"},
+		{"payee and memo", ynabRow{Category: "Fun: Coffee", Payee: "Blue Coffee Co", Memo: "work"}, "Assets:Unknown", "Expenses:Business:Meals"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := mapAccount(m, tc.row); got != tc.account {
+				t.Errorf("mapAccount() = %q, want %q", got, tc.account)
+			}
+			if got := mapCategory(m, tc.row); got != tc.category {
+				t.Errorf("mapCategory() = %q, want %q", got, tc.category)
+			}
+		})
+	}
+}
+
+func TestMappingRuleErrors(t *testing.T) {
+	tests := []string{
+		"rules:\n  - category: \"Bills*\"\n",
+		"rules:\n  - target: Expenses:Misc\n",
+		"rules:\n  - category: \"/(/\"\n    target: Expenses:Misc\n",
+		"rules:\n  - category: \"x\"\n    apply: payee\n    target: Expenses:Misc\n",
+	}
+	for _, data := range tests {
+		if _, err := parseMapping([]byte(data)); err == nil {
+			t.Errorf("parseMapping(%q) should fail", data)
+		}
+	}
+}
+
+func TestMappingCategoryGroups(t *testing.T) {
+	m, err := parseMapping([]byte(`
+categories:
+  "Monthly Bills: Rent": Expenses:Housing
+  "Monthly Bills": Expenses:Bills
+  "Just for Fun: *": Expenses:Fun:*
+  "*": Expenses:Unknown
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"Monthly Bills: Rent":      "Expenses:Housing",
+		"Monthly Bills: Internet":  "Expenses:Bills",
+		"Just for Fun: Dining Out": "Expenses:Fun:Dining Out",
+		"Savings Goals: Vacation":  "Expenses:Unknown",
+		"Monthly Bills":            "Expenses:Bills",
+	}
+	for category, want := range tests {
+		if got := mapCategory(m, ynabRow{Category: category}); got != want {
+			t.Errorf("mapCategory(%q) = %q, want %q", category, got, want)
+		}
+	}
+}
+
+func TestMappingPayeeTargets(t *testing.T) {
+	m, err := parseMapping([]byte(`
+categories:
+  "Inflow: Ready to Assign": Income:Unknown
+  "*": Expenses:Unknown
+payees:
+  - match: "ACME Corp*"
+    category: "Inflow: *"
+    target: Income:Salary:ACME
+  - match: "Interest"
+    target: Income:Interest
+  - match: "/^Shell (.*)$/"
+    category: "/^$/"
+    name: Shell
+    target: Expenses:Auto:Fuel:$1
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+
+	tests := []struct {
+		row      ynabRow
+		category string
+		payee    string
+	}{
+		{ynabRow{Payee: "ACME Corp", Category: "Inflow: Ready to Assign"}, "Income:Salary:ACME", "ACME Corp"},
+		{ynabRow{Payee: "ACME Corp", Category: "Work: Supplies"}, "Expenses:Unknown", "ACME Corp"},
+		{ynabRow{Payee: "Interest", Category: "Inflow: Ready to Assign"}, "Income:Interest", "Interest"},
+		{ynabRow{Payee: "Shell Station 4", Category: ""}, "Expenses:Auto:Fuel:Station 4", "Shell"},
+		{ynabRow{Payee: "Shell Station 4", Category: "Auto: Fuel"}, "Expenses:Unknown", "Shell Station 4"},
+		{ynabRow{Payee: "Transfer : Interest", Category: ""}, "Expenses:Unknown", "Transfer : Interest"},
+	}
+	for _, tc := range tests {
+		if got := mapCategory(m, tc.row); got != tc.category {
+			t.Errorf("mapCategory(%+v) = %q, want %q", tc.row, got, tc.category)
+		}
+		if got := mapPayee(m, tc.row); got != tc.payee {
+			t.Errorf("mapPayee(%+v) = %q, want %q", tc.row, got, tc.payee)
+		}
+	}
+}
+
+func TestMappingConditionalEntries(t *testing.T) {
+	m, err := parseMapping([]byte(`
+categories:
+  "Food: Groceries":
+    - account: Expenses:Business:Meals
+      when:
+        account: "Business *"
+    - account: Expenses:Food:Costco
+      when: {payee: "Costco*"}
+      from: 2021-01-01
+      until: 2021-12-31
+    - Expenses:Food:Groceries
+  "Fun: Hobbies":
+    account: Expenses:Hobbies:Old
+    until: 2019-12-31
+  "*": Expenses:Unknown
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+
+	tests := []struct {
+		row    ynabRow
+		want   string
+		source string
+	}{
+		{ynabRow{Account: "Business Visa", Category: "Food: Groceries", Date: "03/01/2021"}, "Expenses:Business:Meals", `categories["Food: Groceries"] entry 1 when account Business * (line 4)`},
+		{ynabRow{Account: "Checking", Payee: "Costco #12", Category: "Food: Groceries", Date: "03/01/2021"}, "Expenses:Food:Costco", `categories["Food: Groceries"] entry 2 when payee Costco*, from 2021-01-01, until 2021-12-31 (line 7)`},
+		{ynabRow{Account: "Checking", Payee: "Costco #12", Category: "Food: Groceries", Date: "03/01/2022"}, "Expenses:Food:Groceries", `categories["Food: Groceries"] entry 3 (line 11)`},
+		{ynabRow{Category: "Fun: Hobbies", Date: "12/31/2019"}, "Expenses:Hobbies:Old", `categories["Fun: Hobbies"] when until 2019-12-31 (line 13)`},
+		{ynabRow{Category: "Fun: Hobbies", Date: "01/01/2020"}, "Expenses:Unknown", `categories["*"] (line 15)`},
+	}
+	for _, tc := range tests {
+		got := resolveCategory(m, tc.row)
+		if got.Account != tc.want || got.String() != tc.source {
+			t.Errorf("resolveCategory(%+v) = %q from %s, want %q from %s", tc.row, got.Account, got, tc.want, tc.source)
+		}
+	}
+
+	if _, err := parseMapping([]byte("categories:\n  x:\n    when: {payee: y}\n")); err == nil {
+		t.Error("parseMapping() should reject an entry without an account")
+	}
+	if _, err := parseMapping([]byte("categories:\n  x:\n    account: y\n    from: 2021-02-30\n")); err == nil {
+		t.Error("parseMapping() should reject an invalid date")
+	}
+}
+
+func TestMappingAliasesAndDateBounds(t *testing.T) {
+	m, err := parseMapping([]byte(`
+accounts:
+  "Chase Checking":
+    - account: Assets:Bank:Chase:Old
+      aliases: ["Checking"]
+      until: 2020-12-31
+    - account: Assets:Bank:Chase
+      aliases: ["Chase Chk", "Checking"]
+rules:
+  - category: "Old: *"
+    until: 2019-12-31
+    target: Expenses:Legacy:$1
+payees:
+  - match: "Verizon*"
+    from: 2021-01-01
+    name: Verizon Wireless
+`))
+	if err != nil {
+		t.Fatalf("parseMapping() error = %v", err)
+	}
+
+	accounts := []struct {
+		row    ynabRow
+		want   string
+		source string
+	}{
+		{ynabRow{Account: "Chase Checking", Date: "01/01/2020"}, "Assets:Bank:Chase:Old", `accounts["Chase Checking"] entry 1 when until 2020-12-31 (line 4)`},
+		{ynabRow{Account: "Checking", Date: "01/01/2020"}, "Assets:Bank:Chase:Old", `accounts["Chase Checking"] entry 1 via alias "Checking" when until 2020-12-31 (line 4)`},
+		{ynabRow{Account: "Checking", Date: "01/01/2021"}, "Assets:Bank:Chase", `accounts["Chase Checking"] entry 2 via alias "Checking" (line 7)`},
+		{ynabRow{Account: "Chase Chk", Date: "01/01/2020"}, "Assets:Bank:Chase", `accounts["Chase Checking"] entry 2 via alias "Chase Chk" (line 7)`},
+	}
+	for _, tc := range accounts {
+		got := resolveAccount(m, tc.row)
+		if got.Account != tc.want || got.String() != tc.source {
+			t.Errorf("resolveAccount(%+v) = %q from %s, want %q from %s", tc.row, got.Account, got, tc.want, tc.source)
+		}
+	}
+
+	if got := mapCategory(m, ynabRow{Category: "Old: Misc", Date: "12/31/2019"}); got != "Expenses:Legacy:Misc" {
+		t.Errorf("mapCategory() before until = %q", got)
+	}
+	if got := mapCategory(m, ynabRow{Category: "Old: Misc", Date: "01/01/2020"}); got != "Expenses:Unknown" {
+		t.Errorf("mapCategory() after until = %q", got)
+	}
+	if got := mapPayee(m, ynabRow{Payee: "Verizon 123", Date: "12/31/2020"}); got != "Verizon 123" {
+		t.Errorf("mapPayee() before from = %q", got)
+	}
+	if got := mapPayee(m, ynabRow{Payee: "Verizon 123", Date: "01/01/2021"}); got != "Verizon Wireless" {
+		t.Errorf("mapPayee() after from = %q", got)
+	}
+
+	for _, bad := range []string{
+		"accounts:\n  a: x\n  b:\n    account: y\n    aliases: [a]\n",
+		"accounts:\n  a:\n    account: x\n    aliases: [c]\n  b:\n    account: y\n    aliases: [c]\n",
+		"rules:\n  - category: x\n    from: 2021-01-01\n    until: 2020-01-01\n    target: y\n",
+	} {
+		if _, err := parseMapping([]byte(bad)); err == nil {
+			t.Errorf("parseMapping(%q) should fail", bad)
+		}
+	}
+}
+
+// plainValues builds mapping values from plain account names.
+func plainValues(names map[string]string) map[string]MappingValue {
+	values := make(map[string]MappingValue, len(names))
+	for key, account := range names {
+		values[key] = MappingValue{{Account: account}}
+	}
+	return values
+}
+
+func TestLedgerMapping(t *testing.T) {
+	m, err := parseLedgerMapping([]byte(`; Accounts declared for the journal
+account Assets:Bank:Chase
+    ; ynab: Chase Checking
+    ; ynab: Old Checking
+    alias chase
+
+account Liabilities:Visa  ; ynab: Citi Visa
+account Assets:Unknown
+    ; ynab: *
+
+account Expenses:Food:Dining
+    ; ynab: Just for Fun: Dining Out
+    ; note: eating out
+account Equity:Opening Balances
+    ; ynab-account: Starting Balances
+account Expenses:Unknown
+    ; YNAB: *
+
+2021/01/02 Grocer
+    ; ynab: Not a declaration
+    Expenses:Food   $5.00
+    Assets:Bank:Chase
+`))
+	if err != nil {
+		t.Fatalf("parseLedgerMapping() error = %v", err)
+	}
+
+	tests := []struct {
+		row      ynabRow
+		account  string
+		category string
+	}{
+		{ynabRow{Account: "Chase Checking", Category: "Just for Fun: Dining Out"}, "Assets:Bank:Chase", "Expenses:Food:Dining"},
+		{ynabRow{Account: "Old Checking", Category: "Bills: Phone"}, "Assets:Bank:Chase", "Expenses:Unknown"},
+		{ynabRow{Account: "Citi Visa", Category: "Not a declaration"}, "Liabilities:Visa", "Expenses:Unknown"},
+		{ynabRow{Account: "Starting Balances"}, "Equity:Opening Balances", "Expenses:Unknown"},
+		{ynabRow{Account: "Savings"}, "Assets:Unknown", "Expenses:Unknown"},
+	}
+	for _, tt := range tests {
+		if got := mapAccount(m, tt.row); got != tt.account {
+			t.Errorf("mapAccount(%q) = %q, want %q", tt.row.Account, got, tt.account)
+		}
+		if got := mapCategory(m, tt.row); got != tt.category {
+			t.Errorf("mapCategory(%q) = %q, want %q", tt.row.Category, got, tt.category)
+		}
+	}
+	if line := m.Categories["Just for Fun: Dining Out"][0].Line; line != 12 {
+		t.Errorf("entry line = %d, want 12", line)
+	}
+
+	_, err = parseLedgerMapping([]byte("account Expenses:Food\n    ; ynab: Food\naccount Expenses:Dining\n    ; ynab: Food\n"))
+	if err == nil || err.Error() != `line 4: categories["Food"] is already mapped to Expenses:Food at line 2` {
+		t.Errorf("duplicate name error = %v", err)
+	}
+}
+
+func TestMappingFormats(t *testing.T) {
+	files := map[string]string{
+		"coa.yaml": `accounts:
+  "Chase Checking": Assets:Bank:Chase
+  "*": Assets:Unknown
+categories:
+  "Groceries":
+    - account: Expenses:Business:Meals
+      when: {payee: "Client*"}
+      tags: [deductible]
+    - Expenses:Food
+  "*": Expenses:Unknown
+rules:
+  - category: "/^Bills: (.*)$/"
+    target: Expenses:Bills:$1
+    from: 2021-01-01
+`,
+		"coa.json": `{
+	"$schema": "./mapping.schema.json",
+	"accounts": {
+		"Chase Checking": "Assets:Bank:Chase",
+		"*": "Assets:Unknown"
+	},
+	"categories": {
+		"Groceries": [
+			{"account": "Expenses:Business:Meals", "when": {"payee": "Client*"},
+			 "tags": ["deductible"]},
+			"Expenses:Food"
+		],
+		"*": "Expenses:Unknown"
+	},
+	"rules": [
+		{"category": "/^Bills: (.*)$/", "target": "Expenses:Bills:$1", "from": "2021-01-01"}
+	]
+}
+`,
+		"coa.toml": `# Mapping for the household
+[accounts]
+"Chase Checking" = "Assets:Bank:Chase"
+"*" = 'Assets:Unknown'
+
+[categories]
+Groceries = [
+  { account = "Expenses:Business:Meals", when = { payee = "Client*" }, tags = ["deductible"] },
+  """Expenses:\
+     Food""",
+]
+"*" = "Expenses:Unknown"
+
+[[rules]]
+category = '/^Bills: (.*)$/'
+target = "Expenses:Bills:$1"
+from = 2021-01-01
+`,
+	}
+
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := loadMapping(path)
+		if err != nil {
+			t.Fatalf("loadMapping(%s) error = %v", name, err)
+		}
+		rows := []struct {
+			row      ynabRow
+			account  string
+			category string
+		}{
+			{ynabRow{Account: "Chase Checking", Category: "Groceries", Payee: "Client Lunch"}, "Assets:Bank:Chase", "Expenses:Business:Meals"},
+			{ynabRow{Account: "Savings", Category: "Groceries", Payee: "Grocer"}, "Assets:Unknown", "Expenses:Food"},
+			{ynabRow{Category: "Bills: Phone", Date: "02/01/2021"}, "Assets:Unknown", "Expenses:Bills:Phone"},
+			{ynabRow{Category: "Bills: Phone", Date: "12/01/2020"}, "Assets:Unknown", "Expenses:Unknown"},
+		}
+		for _, tt := range rows {
+			if got := mapAccount(m, tt.row); got != tt.account {
+				t.Errorf("%s: mapAccount(%q) = %q, want %q", name, tt.row.Account, got, tt.account)
+			}
+			if got := mapCategory(m, tt.row); got != tt.category {
+				t.Errorf("%s: mapCategory(%q) = %q, want %q", name, tt.row.Category, got, tt.category)
+			}
+		}
+		if tags := m.Categories["Groceries"][0].Tags; len(tags) != 1 || tags[0] != "deductible" {
+			t.Errorf("%s: tags = %v", name, tags)
+		}
+	}
+
+	// Lines are those of the file, whatever its format
+	m, _ := loadMapping(filepath.Join(dir, "coa.toml"))
+	if line := m.Categories["Groceries"][1].Line; line != 9 {
+		t.Errorf("coa.toml entry line = %d, want 9", line)
+	}
+	if line := m.Rules[0].Line; line != 14 {
+		t.Errorf("coa.toml rule line = %d, want 14", line)
+	}
+}
+
+func TestMappingErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"coa.yaml", "accounts:\n  Checking: Assets:Bank\n  Savings:\n    account: Assets:Savings\n    from: 2021-02-30\n",
+			`coa.yaml: line 5: accounts["Savings"]: invalid date "2021-02-30" (want yyyy-mm-dd)`},
+		{"coa.yaml", "categories:\n  Food:\n    account: Expenses:Food\n    tags: deductible\n",
+			`coa.yaml: line 4: categories["Food"]: cannot unmarshal !!str ` + "`deductible`" + ` into []string`},
+		{"coa.yaml", "accounts:\n  Checking: Assets:Bank\n  Checking: Assets:Other\n",
+			`coa.yaml: line 3: accounts["Checking"]: defined twice, first at line 2`},
+		{"coa.yaml", "categories:\n  Home:\n    account: Expenses:Home\n    metadata:\n      \"job site\": Main St\n",
+			`coa.yaml: line 3: categories["Home"]: invalid metadata key "job site"`},
+		{"coa.yaml", "categories:\n  Home:\n    account: Expenses:Home\n    metadata: {project: \"kitchen\\nExpenses:Fake  $1\"}\n",
+			`coa.yaml: line 3: categories["Home"]: invalid metadata value "kitchen\nExpenses:Fake  $1" for project: line breaks are not allowed`},
+		{"coa.json", "{\n  \"rules\": [\n    {\"payee\": \"Grocer\", \"target\": \"Expenses:Food\"},\n    {\"category\": \"Food\", \"apply\": \"both\", \"target\": \"Expenses:Food\"}\n  ]\n}\n",
+			`coa.json: line 4: rules[2]: invalid apply "both" (want category or account)`},
+		{"coa.json", "{\"categories\": {\"Food\": [\"Expenses:Food\", {\"account\": \"Expenses:Food\", \"when\": {\"payee\": \"/(/\"}}]}}",
+			`coa.json: line 1: categories["Food"] entry 2: invalid pattern "/(/"`},
+		{"coa.toml", "[accounts]\nChecking = \"Assets:Bank\"\n\n[[payees]]\nmatch = \"Grocer*\"\n",
+			`coa.toml: line 4: payees[1]: needs a name, a target or both`},
+		{"coa.toml", "[accounts]\nChecking = Assets:Bank\n",
+			`coa.toml: line 2: incomplete number`},
+		{"coa.toml", "[accounts]\nChecking = \"Assets:Bank\"\nChecking = \"Assets:Other\"\n",
+			`coa.toml: line 3: key Checking is already defined`},
+		{"coa.toml", "[accounts]\nChecking = \"Assets:Bank\"\n\n[categories]\nFood = \"Expenses:Food\"\n\n[accounts]\nSavings = \"Assets:Savings\"\n",
+			`coa.toml: line 7: table accounts already exists`},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadMapping(path)
+		if err == nil {
+			t.Errorf("loadMapping(%q) succeeded, want %s", tt.data, tt.want)
+			continue
+		}
+		if got := strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("loadMapping(%q) error = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
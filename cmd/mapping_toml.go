@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// parseTOML parses a TOML document into a YAML node tree, so that a TOML
+// mapping file decodes and validates like coa.yaml, with its lines. The
+// document is decoded by go-toml, which enforces the TOML spec, and the
+// lines of its keys are taken from go-toml's parser. Dates become strings.
+func parseTOML(data []byte) (*yaml.Node, error) {
+	var values map[string]any
+	if err := toml.Unmarshal(data, &values); err != nil {
+		return nil, tomlError(data, err)
+	}
+	layout := scanTOML(data)
+	root := tomlNode(values, "", layout)
+	root.Line, root.Column = 1, 1
+	return &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Column: 1, Content: []*yaml.Node{root}}, nil
+}
+
+// tomlError adds the line of a TOML decoding error to it.
+func tomlError(data []byte, err error) error {
+	msg := strings.TrimPrefix(err.Error(), "toml: ")
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &decodeErr) {
+		line, _ := decodeErr.Position()
+		return fmt.Errorf("line %d: %s", line, msg)
+	}
+
+	// Errors in the structure of the document, such as a table defined
+	// twice, come without a position: find the first expression that the
+	// document no longer decodes with
+	lines := scanTOML(data).lines
+	i := sort.Search(len(lines), func(i int) bool {
+		end := len(data)
+		if i+1 < len(lines) {
+			end = lineOffset(data, lines[i+1])
+		}
+		var values map[string]any
+		return toml.Unmarshal(data[:end], &values) != nil
+	})
+	if i == len(lines) {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("line %d: %s", lines[i], msg)
+}
+
+// lineOffset returns the offset of the start of a line, counted from 1.
+func lineOffset(data []byte, line int) int {
+	offset := 0
+	for ; line > 1; line-- {
+		i := strings.IndexByte(string(data[offset:]), '\n')
+		if i < 0 {
+			return len(data)
+		}
+		offset += i + 1
+	}
+	return offset
+}
+
+// tomlLayout is where the keys and values of a TOML document are.
+type tomlLayout struct {
+	// positions holds the first position of every key, array of tables
+	// element and array element, by path, such as `."rules"[0]."when"`
+	positions map[string]unstable.Position
+	// lines holds the first line of every expression
+	lines []int
+}
+
+func (l *tomlLayout) record(path string, pos unstable.Position) {
+	if _, ok := l.positions[path]; !ok {
+		l.positions[path] = pos
+	}
+}
+
+// scanTOML reads the layout of a TOML document, up to its first syntax
+// error if any.
+func scanTOML(data []byte) *tomlLayout {
+	l := &tomlLayout{positions: make(map[string]unstable.Position)}
+	arrays := make(map[string]int) // elements of each array of tables so far
+	table := ""
+
+	var p unstable.Parser
+	p.Reset(data)
+	for p.NextExpression() {
+		expr := p.Expression()
+		if expr.Kind != unstable.Table && expr.Kind != unstable.ArrayTable && expr.Kind != unstable.KeyValue {
+			continue
+		}
+
+		var keys []*unstable.Node
+		for it := expr.Key(); it.Next(); {
+			keys = append(keys, it.Node())
+		}
+		start := p.Shape(keys[0].Raw).Start
+		l.lines = append(l.lines, start.Line)
+
+		path := ""
+		if expr.Kind == unstable.KeyValue {
+			path = table
+		}
+		for i, key := range keys {
+			path += "." + strconv.Quote(string(key.Data))
+			l.record(path, p.Shape(key.Raw).Start)
+			// A table header goes into the last element of the arrays of
+			// tables on its path
+			if n := arrays[path]; n > 0 && expr.Kind != unstable.KeyValue && i < len(keys)-1 {
+				path += fmt.Sprintf("[%d]", n-1)
+			}
+		}
+
+		switch expr.Kind {
+		case unstable.Table:
+			table = path
+		case unstable.ArrayTable:
+			arrays[path]++
+			table = fmt.Sprintf("%s[%d]", path, arrays[path]-1)
+			l.record(table, start)
+		case unstable.KeyValue:
+			l.scanValue(&p, path, expr.Value(), p.Shape(keys[len(keys)-1].Raw).Start)
+		}
+	}
+	return l
+}
+
+// scanValue records the layout of the inline tables and arrays in a value.
+func (l *tomlLayout) scanValue(p *unstable.Parser, path string, value *unstable.Node, pos unstable.Position) {
+	switch value.Kind {
+	case unstable.InlineTable:
+		for it := value.Children(); it.Next(); {
+			kv := it.Node()
+			if kv.Kind != unstable.KeyValue {
+				continue
+			}
+			keyPath := path
+			var keyPos unstable.Position
+			for keys := kv.Key(); keys.Next(); {
+				keyPos = p.Shape(keys.Node().Raw).Start
+				keyPath += "." + strconv.Quote(string(keys.Node().Data))
+				l.record(keyPath, keyPos)
+			}
+			l.scanValue(p, keyPath, kv.Value(), keyPos)
+		}
+	case unstable.Array:
+		i := 0
+		for it := value.Children(); it.Next(); {
+			elem := it.Node()
+			if elem.Kind == unstable.Comment {
+				continue
+			}
+			elemPos := pos
+			if elem.Raw.Length > 0 {
+				elemPos = p.Shape(elem.Raw).Start
+			}
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			l.record(elemPath, elemPos)
+			l.scanValue(p, elemPath, elem, elemPos)
+			i++
+		}
+	}
+}
+
+// tomlNode converts a value decoded by go-toml into a YAML node, with the
+// position of its key, and the keys of tables in the order they appear.
+func tomlNode(value any, path string, l *tomlLayout) *yaml.Node {
+	pos := l.positions[path]
+	node := &yaml.Node{Kind: yaml.ScalarNode, Line: pos.Line, Column: pos.Column}
+	switch v := value.(type) {
+	case map[string]any:
+		node.Kind, node.Tag = yaml.MappingNode, "!!map"
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		keyPath := func(key string) string { return path + "." + strconv.Quote(key) }
+		sort.Slice(keys, func(i, j int) bool {
+			return l.positions[keyPath(keys[i])].Offset < l.positions[keyPath(keys[j])].Offset
+		})
+		for _, key := range keys {
+			keyPos := l.positions[keyPath(key)]
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: keyPos.Line, Column: keyPos.Column},
+				tomlNode(v[key], keyPath(key), l))
+		}
+	case []any:
+		node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+		for i, elem := range v {
+			node.Content = append(node.Content, tomlNode(elem, fmt.Sprintf("%s[%d]", path, i), l))
+		}
+	case string:
+		node.Tag, node.Value = "!!str", v
+	case bool:
+		node.Tag, node.Value = "!!bool", strconv.FormatBool(v)
+	case int64:
+		node.Tag, node.Value = "!!int", strconv.FormatInt(v, 10)
+	case float64:
+		node.Tag = "!!float"
+		switch {
+		case math.IsInf(v, 1):
+			node.Value = ".inf"
+		case math.IsInf(v, -1):
+			node.Value = "-.inf"
+		case math.IsNaN(v):
+			node.Value = ".nan"
+		default:
+			node.Value = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case time.Time:
+		node.Tag, node.Value = "!!str", v.Format(time.RFC3339Nano)
+	default:
+		// Local dates and times
+		node.Tag, node.Value = "!!str", fmt.Sprint(v)
+	}
+	return node
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseTOML(t *testing.T) {
+	valid := []struct {
+		toml, yaml string
+	}{
+		{"a = 'x'\nb = \"\\u00e9\\t\"\nc = '''\nraw\\n'''\n", `{a: x, b: "é\t", c: "raw\\n"}`},
+		{"a.b.c = 1\na.d = true\n", `{a: {b: {c: 1}, d: true}}`},
+		{"[a]\nb = 1\n[a.c]\nd = 2\n", `{a: {b: 1, c: {d: 2}}}`},
+		{"[a.b]\nc = 1\n[a]\nd = 2\n", `{a: {b: {c: 1}, d: 2}}`},
+		{"[[r]]\nx = 1\n[r.when]\ny = 2\n[[r]]\nx = 3\n", `{r: [{x: 1, when: {y: 2}}, {x: 3}]}`},
+		{"r = [{x = 1}, {x = 2, y = [1, 2]}]\n", `{r: [{x: 1}, {x: 2, y: [1, 2]}]}`},
+		{"n = [0x1F, 1_000, 1e3, -0.5, +inf]\n", `{n: [31, 1000, 1000.0, -0.5, .inf]}`},
+		{"d = 2021-01-02\nt = 1979-05-27T07:32:00Z\n", `{d: "2021-01-02", t: "1979-05-27T07:32:00Z"}`},
+		{"\"quoted key\" = 1\n'*' = 2\n", `{"quoted key": 1, "*": 2}`},
+	}
+	for _, tt := range valid {
+		doc, err := parseTOML([]byte(tt.toml))
+		if err != nil {
+			t.Errorf("parseTOML(%q) error = %v", tt.toml, err)
+			continue
+		}
+		var got, want any
+		if err := doc.Decode(&got); err != nil {
+			t.Errorf("parseTOML(%q) does not decode: %v", tt.toml, err)
+			continue
+		}
+		if err := yaml.Unmarshal([]byte(tt.yaml), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseTOML(%q) = %v, want %v", tt.toml, got, want)
+		}
+	}
+
+	// Keys keep their lines and order
+	doc, err := parseTOML([]byte("z = 1\n\n[[rules]]\nb = 2\n\n[[rules]]\na = [\n  {c = 3},\n]\n"))
+	if err != nil {
+		t.Fatalf("parseTOML() error = %v", err)
+	}
+	root := doc.Content[0]
+	rules := root.Content[3]
+	var lines []int
+	for _, n := range []*yaml.Node{root.Content[0], root.Content[2], rules.Content[0], rules.Content[1], rules.Content[1].Content[1].Content[0]} {
+		lines = append(lines, n.Line)
+	}
+	if root.Content[0].Value != "z" || !reflect.DeepEqual(lines, []int{1, 3, 3, 6, 8}) {
+		t.Errorf("parseTOML() keys %s, %s at lines %v, want z, rules at 1, 3, 3, 6, 8", root.Content[0].Value, root.Content[2].Value, lines)
+	}
+
+	invalid := []struct {
+		toml, want string
+	}{
+		{"a = {b = 1}\n[a]\nc = 2\n", "line 2: "},
+		{"a = {b = 1}\n[a.c]\nd = 2\n", "line 2: "},
+		{"x = 1\n\n[a]\nb = 1\n[a]\nc = 2\n", "line 5: "},
+		{"x = 1\nx = 2\n", "line 2: "},
+		{"a.b = 1\n[a]\nc = 1\n", "line 2: "},
+		{"[[r]]\nx = 1\n[r]\n", "line 3: "},
+		{"a = [1, 2]\n[[a]]\n", "line 2: "},
+		{"a = {b = 1}\na.c = 2\n", "line 2: "},
+		{"k = Assets:Bank\n", "line 1: "},
+		{"s = \"\\q\"\n", "line 1: "},
+		{"d = 2021-02-30\n", "line 1: "},
+		{"a = 1 b = 2\n", "line 1: "},
+		{"[a\nb = 1\n", "line 1: "},
+		{"a = \"x\n", "line 1: "},
+		{"a = [1,,2]\n", "line 1: "},
+		{"a = {b = 1,}\n", "line 1: "},
+	}
+	for _, tt := range invalid {
+		_, err := parseTOML([]byte(tt.toml))
+		if err == nil {
+			t.Errorf("parseTOML(%q) should fail", tt.toml)
+		} else if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("parseTOML(%q) error = %v, want it at %s", tt.toml, err, strings.TrimSuffix(tt.want, ": "))
+		}
+	}
+}
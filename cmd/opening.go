@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"sort"
+	"time"
+)
+
+// openingBalances accumulates the balance of every mapped YNAB account from
+// the rows that fall before the --since cutover, so that the journal can start
+// at the cutover with the same balances YNAB shows.
+type openingBalances struct {
+	balances  map[string]int64 // milliunits per Ledger account
+	commodity string
+}
+
+func newOpeningBalances() *openingBalances {
+	return &openingBalances{balances: make(map[string]int64)}
+}
+
+// add applies a pre-cutover row the same way ledgerEntry would post it.
+// Category postings are left out: pre-cutover income and expenses are
+// absorbed by the equity account.
+func (o *openingBalances) add(row ynabRow, mapping *Mapping) {
+	inflow, _ := parseAmount(row.Inflow)
+	outflow, _ := parseAmount(row.Outflow)
+	if o.commodity == "" {
+		o.commodity = amountCommodity(row.Outflow)
+		if o.commodity == "" {
+			o.commodity = amountCommodity(row.Inflow)
+		}
+	}
+
+	account := mapAccount(mapping, row)
+	if other, ok := transferAccount(row.Payee); ok {
+		// Transfers are only rendered from their outflow side
+		if outflow == 0 {
+			return
+		}
+		o.balances[account] -= outflow
+		o.balances[mapAccount(mapping, row.withAccount(other))] += outflow
+		return
+	}
+	o.balances[account] += inflow - outflow
+}
+
+// entry renders a single opening-balance transaction dated at the cutover,
+// balanced against the equity account. It reports false when every balance
+// is zero.
+func (o *openingBalances) entry(date time.Time, equity string) (journalEntry, bool) {
+	postings := sortedPostings(o.balances, func(string) bool { return true })
+	if len(postings) == 0 {
+		return journalEntry{}, false
+	}
+
+	e := renderEntry(date, "Opening Balances", postings, equity, o.commodity)
+	e.Seq = -1 // not from a row, so it stays at the edge of the cutover day
+	return e, true
+}
+
+// sortedPostings turns the non-zero balances of the accounts selected by keep
+// into postings ordered by account name.
+func sortedPostings(balances map[string]int64, keep func(account string) bool) []entryPosting {
+	var postings []entryPosting
+	for acct, bal := range balances {
+		if bal != 0 && keep(acct) {
+			postings = append(postings, entryPosting{Account: acct, Amount: bal})
+		}
+	}
+	sort.Slice(postings, func(i, j int) bool { return postings[i].Account < postings[j].Account })
+	return postings
+}
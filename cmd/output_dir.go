@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// accountWriter writes the entries of each mapped account to its own file
+// under <dir>/accounts and an index.ledger that includes them all. Entries
+// are grouped by journalEntry.Account, so a transfer lands only in the file
+// of its outflow side.
+type accountWriter struct {
+	dir   string
+	files map[string]*journalStream // by Ledger account
+	paths map[string]string         // relative file path by Ledger account
+	slugs map[string]bool
+
+	directives []string // written at the top of index.ledger
+}
+
+func newAccountWriter(dir string) (*accountWriter, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "accounts"), 0755); err != nil {
+		return nil, err
+	}
+	return &accountWriter{
+		dir:   dir,
+		files: make(map[string]*journalStream),
+		paths: make(map[string]string),
+		slugs: make(map[string]bool),
+	}, nil
+}
+
+// WriteDirective queues a directive for the top of index.ledger.
+func (a *accountWriter) WriteDirective(line string) error {
+	a.directives = append(a.directives, line)
+	return nil
+}
+
+func (a *accountWriter) WriteEntry(e journalEntry) error {
+	out, ok := a.files[e.Account]
+	if !ok {
+		slug := accountSlug(e.Account)
+		for n := 2; a.slugs[slug]; n++ {
+			slug = fmt.Sprintf("%s-%d", accountSlug(e.Account), n)
+		}
+		a.slugs[slug] = true
+
+		rel := filepath.Join("accounts", slug+".ledger")
+		var err error
+		if out, err = createJournalFile(filepath.Join(a.dir, rel)); err != nil {
+			return err
+		}
+		a.files[e.Account] = out
+		a.paths[e.Account] = rel
+	}
+	return out.WriteEntry(e)
+}
+
+// Close finishes every account file and writes index.ledger.
+func (a *accountWriter) Close() error {
+	var firstErr error
+	for _, out := range a.files {
+		if err := out.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	paths := make([]string, 0, len(a.paths))
+	for _, rel := range a.paths {
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	sort.Strings(paths)
+
+	index, err := createJournalFile(filepath.Join(a.dir, "index.ledger"))
+	if err != nil {
+		return err
+	}
+	lines := append([]string(nil), a.directives...)
+	for _, rel := range paths {
+		lines = append(lines, "include "+rel)
+	}
+	for _, line := range lines {
+		if err := index.WriteLine(line); err != nil {
+			index.Close()
+			return err
+		}
+	}
+	return index.Close()
+}
+
+// accountSlug turns a Ledger account into a file name, e.g.
+// "Assets:Chase Checking" becomes "assets-chase-checking".
+func accountSlug(account string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(account) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if sb.Len() == 0 {
+		return "account"
+	}
+	return sb.String()
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccountWriter(t *testing.T) {
+	testMapping := &Mapping{
+		Accounts: plainValues(map[string]string{
+			"Chase Checking":   "Assets:Chase Checking",
+			"American Express": "Liabilities:Amex",
+		}),
+		Categories: plainValues(map[string]string{"*": "Expenses:Misc"}),
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Chase Checking","","12/18/2020","Transfer : American Express","","","","",$194.17,$0.00,"Cleared"
+"American Express","","12/18/2020","Transfer : Chase Checking","","","","",$0.00,$194.17,"Cleared"
+"American Express","","12/10/2020","Cafe","Fun: Coffee","Fun","Coffee","",$3.00,$0.00,"Cleared"`
+
+	dir := t.TempDir()
+	out, err := newAccountWriter(dir)
+	if err != nil {
+		t.Fatalf("newAccountWriter() error = %v", err)
+	}
+	if _, err := convertTo(strings.NewReader(csv), out, testMapping, defaultConvertOptions()); err != nil {
+		t.Fatalf("convertTo() error = %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	expected := map[string]string{
+		"index.ledger":                          "include accounts/assets-chase-checking.ledger\ninclude accounts/liabilities-amex.ledger\n",
+		"accounts/assets-chase-checking.ledger": "2020/12/18 Transfer : American Express\n    Liabilities:Amex  $194.17\n    Assets:Chase Checking  ",
+		"accounts/liabilities-amex.ledger":      "2020/12/10 Cafe\n    Expenses:Misc  $3.00\n    Liabilities:Amex  ",
+	}
+	for name, want := range expected {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOpenJournalRejectsCombinations(t *testing.T) {
+	dir := t.TempDir()
+	tests := []convertOptions{
+		{OutputDir: dir, SplitBy: "year"},
+		{OutputDir: dir, CloseYears: true},
+		{CloseYears: true},
+	}
+	for _, opts := range tests {
+		if _, _, err := openJournal(filepath.Join(dir, "out.ledger"), opts); err == nil {
+			t.Errorf("openJournal(%+v) should fail", opts)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.ledger")); err == nil {
+		t.Error("openJournal() wrote index.ledger for a rejected combination")
+	}
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// registerColumns holds the positions of the Register.csv columns we use.
+type registerColumns struct {
+	account  int
+	date     int
+	payee    int
+	category int
+	memo     int
+	outflow  int
+	inflow   int
+}
+
+// findRegisterColumns locates the required columns in a header row.
+func findRegisterColumns(headers []string) (registerColumns, error) {
+	c := registerColumns{
+		account:  findColumnIndex(headers, "Account"),
+		date:     findColumnIndex(headers, "Date"),
+		payee:    findColumnIndex(headers, "Payee"),
+		category: findColumnIndex(headers, "Category Group/Category"),
+		memo:     findColumnIndex(headers, "Memo"),
+		outflow:  findColumnIndex(headers, "Outflow"),
+		inflow:   findColumnIndex(headers, "Inflow"),
+	}
+	if c.account == -1 || c.date == -1 || c.payee == -1 ||
+		c.category == -1 || c.memo == -1 ||
+		c.outflow == -1 || c.inflow == -1 {
+		return c, fmt.Errorf("required column not found in CSV. Headers found: %v", headers)
+	}
+	return c, nil
+}
+
+// ynabRow holds the fields of one register row.
+type ynabRow struct {
+	Line     int // line in the export, counting the header as line 1
+	Account  string
+	Date     string
+	Payee    string
+	Category string // "Group: Category"
+	Memo     string
+	Outflow  string
+	Inflow   string
+}
+
+// withAccount returns a copy of the row as seen from another account, used
+// to map the far side of a transfer.
+func (r ynabRow) withAccount(account string) ynabRow {
+	r.Account = account
+	return r
+}
+
+// maxIndex returns the highest column index a row must contain.
+func (c registerColumns) maxIndex() int {
+	return max(c.account, c.date, c.payee, c.category, c.memo, c.outflow, c.inflow)
+}
+
+// registerReader yields the rows of a YNAB register export one at a time, so
+// that a conversion never needs more than a single line of the input in memory.
+type registerReader struct {
+	cols registerColumns
+
+	src       *bufio.Reader
+	delimiter string
+	csv       *csv.Reader // nil when the fallback line parser is in use
+	line      int
+}
+
+// newRegisterReader reads the header row of r and prepares to stream the
+// remaining rows. The BOM is removed, line endings are normalised and bare
+// quotes are repaired line by line as the input is consumed. Diagnostics go
+// to stderr, as several commands write their results to stdout.
+func newRegisterReader(r io.Reader) (*registerReader, error) {
+	src := bufio.NewReader(r)
+
+	// Remove BOM if present
+	if head, _ := src.Peek(3); len(removeBOM(head)) != len(head) {
+		if _, err := src.Discard(3); err != nil {
+			return nil, fmt.Errorf("failed to read file content: %w", err)
+		}
+	}
+
+	headerLine, err := readRegisterLine(src)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+
+	// Try to detect the delimiter
+	delimiter := detectDelimiter(headerLine)
+	fmt.Fprintf(os.Stderr, "Detected delimiter: %q\n", delimiter)
+
+	rr := &registerReader{src: src, delimiter: delimiter, line: 1}
+
+	headers, err := newRegisterCSV(strings.NewReader(fixBareQuotes(headerLine, delimiter)), delimiter).Read()
+	if err != nil {
+		// If standard parsing fails, fall back to parsing each line by hand
+		fmt.Fprintln(os.Stderr, "Standard CSV parsing failed, trying fallback method...")
+		headers = parseCSVLine(headerLine, delimiter)
+	} else {
+		rr.csv = newRegisterCSV(&cleanLineReader{src: src, delimiter: delimiter}, delimiter)
+	}
+
+	if rr.cols, err = findRegisterColumns(headers); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// newRegisterCSV creates a CSV reader configured to be lenient about the
+// formatting quirks found in YNAB exports.
+func newRegisterCSV(r io.Reader, delimiter string) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1 // Allow variable number of fields
+	reader.TrimLeadingSpace = true
+	reader.Comma = rune(delimiter[0])
+	return reader
+}
+
+// Read returns the next row that has every required column, or io.EOF.
+func (rr *registerReader) Read() (ynabRow, error) {
+	for {
+		fields, line, err := rr.next()
+		if err != nil {
+			return ynabRow{}, err
+		}
+		c := rr.cols
+		if len(fields) <= c.maxIndex() {
+			fmt.Fprintf(os.Stderr, "Warning: Skipping line %d due to insufficient fields\n", line)
+			continue
+		}
+		return ynabRow{
+			Line:     line,
+			Account:  fields[c.account],
+			Date:     fields[c.date],
+			Payee:    fields[c.payee],
+			Category: fields[c.category],
+			Memo:     fields[c.memo],
+			Outflow:  fields[c.outflow],
+			Inflow:   fields[c.inflow],
+		}, nil
+	}
+}
+
+func (rr *registerReader) next() ([]string, int, error) {
+	if rr.csv != nil {
+		row, err := rr.csv.Read()
+		if err != nil {
+			return nil, 0, err
+		}
+		line, _ := rr.csv.FieldPos(0)
+		return row, line + 1, nil // +1 for the header consumed separately
+	}
+
+	for {
+		line, err := readRegisterLine(rr.src)
+		if line == "" && err != nil {
+			return nil, 0, err
+		}
+		rr.line++
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		return parseCSVLine(line, rr.delimiter), rr.line, nil
+	}
+}
+
+// readRegisterLine reads a single line without its line ending.
+func readRegisterLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if strings.HasSuffix(line, "\n") {
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	}
+	return line, err
+}
+
+// cleanLineReader feeds the CSV parser one repaired line at a time so that
+// fixBareQuotes never needs to see the whole file at once.
+type cleanLineReader struct {
+	src       *bufio.Reader
+	delimiter string
+	pending   []byte
+	err       error
+}
+
+func (c *cleanLineReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		line, err := c.src.ReadString('\n')
+		c.err = err
+		if line == "" {
+			continue
+		}
+		if strings.HasSuffix(line, "\n") {
+			line = fixBareQuotes(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), c.delimiter) + "\n"
+		} else {
+			line = fixBareQuotes(line, c.delimiter)
+		}
+		c.pending = []byte(line)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
@@ -10,6 +10,9 @@ import (
 var (
 	outputFile  string
 	mappingFile string
+	convertOpts = defaultConvertOptions()
+	explainOpts explainOptions
+	coaOpts     = defaultCOAOptions()
 	rootCmd     = &cobra.Command{
 		Use:   "ynab_to_ledger [file]",
 		Short: "Convert YNAB export to Ledger format",
@@ -33,6 +36,65 @@ in mm/dd/yyyy format and numbers using a period (.) as the decimal separator.`,
 			return GenerateCOA(args[0], args[1])
 		},
 	}
+
+	validateMappingCmd = &cobra.Command{
+		Use:   "validate-mapping [coa.yaml] [register.csv]",
+		Short: "Check a mapping file for mistakes",
+		Long: `Check a mapping file for unknown keys, target accounts Ledger would
+misread, targets outside Assets, Liabilities, Equity, Income and Expenses,
+and targets that differ only in case. Given a register export, also report
+the entries and rules that no row of it uses.`,
+		Args:         cobra.RangeArgs(1, 2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			register := ""
+			if len(args) > 1 {
+				register = args[1]
+			}
+			return validateMappingFile(args[0], register)
+		},
+	}
+
+	explainCmd = &cobra.Command{
+		Use:   "explain [register.csv]",
+		Short: "Show how a register row or a YNAB name is mapped",
+		Long: `Show every mapping step tried for an account, category or payee, which
+entry or rule matched, and its line in the mapping file.
+
+With --row, the row on that line of the register export is explained
+and the transaction it converts to is printed.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return explainFile(args, explainOpts)
+		},
+	}
+
+	mapCmd = &cobra.Command{
+		Use:   "map [register.csv]",
+		Short: "Interactively map the accounts and categories left to the catch-all",
+		Long: `List every account and category of a register export that only the "*"
+catch-all maps, with its totals and sample transactions, and ask which
+account it should map to. Suggestions come from the accounts the mapping
+file already uses, and account names complete with Tab. The answers are
+added to the mapping file, ahead of the catch-all of their section.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return mapFile(args[0])
+		},
+	}
+
+	schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the mapping file format",
+		Long: `Print the JSON Schema of the mapping file format. Save it next to your
+mapping file and point your editor at it to validate and complete coa.yaml,
+coa.json or coa.toml as you type.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printSchema()
+		},
+	}
 )
 
 // Execute executes the root command.
@@ -45,6 +107,42 @@ func Execute() {
 
 func init() {
 	rootCmd.Flags().StringVarP(&outputFile, "output", "o", "ynab_ledger.dat", "output file path")
-	rootCmd.Flags().StringVarP(&mappingFile, "mapping", "m", "coa.yaml", "chart of accounts mapping file")
+	rootCmd.Flags().StringVarP(&mappingFile, "mapping", "m", "coa.yaml", "chart of accounts mapping file: YAML, .json, .toml, or a .ledger or .journal file whose account declarations have ; ynab: notes")
+	rootCmd.Flags().StringVar(&convertOpts.Sort, "sort", convertOpts.Sort, "entry order: date, date-desc or source")
+	rootCmd.Flags().StringVar(&convertOpts.TieBreak, "tie-break", convertOpts.TieBreak, "order of same-day entries: row, account or amount")
+	rootCmd.Flags().StringVar(&convertOpts.Since, "since", "", "only convert transactions on or after this date (yyyy-mm-dd)")
+	rootCmd.Flags().StringVar(&convertOpts.Until, "until", "", "only convert transactions on or before this date (yyyy-mm-dd)")
+	rootCmd.Flags().StringArrayVar(&convertOpts.Accounts, "account", nil, "only convert these YNAB accounts (repeatable, glob patterns allowed)")
+	rootCmd.Flags().StringArrayVar(&convertOpts.Categories, "category", nil, "only convert these YNAB categories (repeatable, glob patterns allowed)")
+	rootCmd.Flags().BoolVar(&convertOpts.OpeningBalances, "opening-balances", convertOpts.OpeningBalances, "with --since, start the journal with the balances of every account at the cutover")
+	rootCmd.Flags().StringVar(&convertOpts.OpeningAccount, "opening-account", convertOpts.OpeningAccount, "equity account that opening balances are posted against")
+	rootCmd.Flags().StringVar(&convertOpts.SplitBy, "split-by", "", "write one journal per year or month, included from the output file")
+	rootCmd.Flags().BoolVar(&convertOpts.CloseYears, "close-years", false, "with --split-by, close Income and Expenses at each year end and carry balances forward")
+	rootCmd.Flags().StringVar(&convertOpts.RetainedEarnings, "retained-earnings", convertOpts.RetainedEarnings, "equity account that year-end closing entries post to")
+	rootCmd.Flags().StringVar(&convertOpts.OutputDir, "output-dir", "", "write one file per account under this directory plus an index.ledger, instead of --output")
+	rootCmd.Flags().BoolVar(&convertOpts.DeclarePayees, "declare-payees", false, "start the journal with a payee declaration for every payee rewritten by the mapping")
+	rootCmd.Flags().BoolVar(&convertOpts.AnnotateMapping, "annotate-mapping", false, "comment every posting with the mapping entry or rule that produced its account")
+	genCoaCmd.Flags().BoolVar(&coaOpts.Merge, "merge", false, "add only the new names to an existing coa.yaml, keeping its entries and comments, and report names no longer in the export")
+	genCoaCmd.Flags().StringArrayVar(&coaOpts.LiabilityNames, "liability-name", coaOpts.LiabilityNames, "suggest Liabilities for accounts whose name matches this glob or /regex/ (repeatable)")
+	genCoaCmd.Flags().Float64Var(&coaOpts.NegativeShare, "negative-share", coaOpts.NegativeShare, "suggest Liabilities for accounts whose balance is negative on more than this share of days (0 to disable)")
+	genCoaCmd.Flags().StringArrayVar(&coaOpts.IncomeCategories, "income-category", coaOpts.IncomeCategories, "suggest Income for categories matching this glob or /regex/ (repeatable)")
+	genCoaCmd.Flags().StringArrayVar(&coaOpts.EquityPayees, "equity-payee", coaOpts.EquityPayees, "map rows of payees matching this glob or /regex/ to --equity-account (repeatable)")
+	genCoaCmd.Flags().StringVar(&coaOpts.EquityAccount, "equity-account", coaOpts.EquityAccount, "equity account for starting balances")
+	genCoaCmd.Flags().StringVar(&coaOpts.Sort, "sort", coaOpts.Sort, "order of entries: name, or volume to list the accounts and categories that move the most money first")
+	genCoaCmd.Flags().StringVar(&coaOpts.Naming, "naming", coaOpts.Naming, "style of suggested account names: spaces, title (TitleCase) or kebab (kebab-case)")
+	genCoaCmd.Flags().StringVar(&coaOpts.LearnFrom, "learn-from", "", "existing Ledger journal to learn accounts from, by matching its transactions to the rows of the export")
 	rootCmd.AddCommand(genCoaCmd)
+
+	explainCmd.Flags().StringVarP(&mappingFile, "mapping", "m", "coa.yaml", "chart of accounts mapping file: YAML, .json, .toml, or a .ledger or .journal file whose account declarations have ; ynab: notes")
+	explainCmd.Flags().IntVar(&explainOpts.Row, "row", 0, "line of the register export to explain, counting the header as line 1")
+	explainCmd.Flags().StringVar(&explainOpts.Account, "account", "", "YNAB account name to explain")
+	explainCmd.Flags().StringVar(&explainOpts.Category, "category", "", "YNAB \"Group: Category\" name to explain")
+	explainCmd.Flags().StringVar(&explainOpts.Payee, "payee", "", "YNAB payee to explain")
+	explainCmd.Flags().StringVar(&explainOpts.Date, "date", "", "date (yyyy-mm-dd) to evaluate date-bounded entries and rules at")
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(validateMappingCmd)
+
+	mapCmd.Flags().StringVarP(&mappingFile, "mapping", "m", "coa.yaml", "chart of accounts mapping file to add the answers to")
+	rootCmd.AddCommand(mapCmd)
+	rootCmd.AddCommand(schemaCmd)
 }
@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	_ "embed"
+	"os"
+)
+
+// mappingSchema is the JSON Schema of the mapping file format, for editors to
+// validate and complete coa.yaml, coa.json and coa.toml files with.
+//
+//go:embed mapping.schema.json
+var mappingSchema []byte
+
+// printSchema writes the JSON Schema to stdout.
+func printSchema() error {
+	_, err := os.Stdout.Write(mappingSchema)
+	return err
+}
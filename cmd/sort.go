@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sortBufferSize is the number of entries held in memory before a sorted run
+// is spilled to a temporary file.
+var sortBufferSize = 20000
+
+// Values accepted by --sort and --tie-break.
+var (
+	sortOrders = []string{"date", "date-desc", "source"}
+	tieBreaks  = []string{"row", "account", "amount"}
+)
+
+// journalEntry is a rendered transaction together with the keys it is sorted
+// by and the postings needed to keep running balances.
+type journalEntry struct {
+	Seq       int       // position of the originating row in the export
+	Date      time.Time // transaction date
+	Account   string    // mapped Ledger account of the originating row
+	Payee     string    // payee as printed
+	Amount    int64     // net change to Account, in milliunits
+	Commodity string
+	Postings  []entryPosting
+	Text      string
+}
+
+// entryPosting is the resolved amount posted to one account, in milliunits.
+type entryPosting struct {
+	Account string
+	Amount  int64
+}
+
+// entryOrder returns the comparison for the given sort order and tie-breaker.
+// Every order falls back to the original row order, so sorting is stable.
+// Entries with a negative Seq are not from a row and sort first on their
+// date, or last with date-desc.
+func entryOrder(order, tieBreak string) (func(a, b *journalEntry) bool, error) {
+	var tie func(a, b *journalEntry) int
+	switch tieBreak {
+	case "row":
+		tie = func(a, b *journalEntry) int { return 0 }
+	case "account":
+		tie = func(a, b *journalEntry) int { return strings.Compare(a.Account, b.Account) }
+	case "amount":
+		tie = func(a, b *journalEntry) int { return cmp.Compare(a.Amount, b.Amount) }
+	default:
+		return nil, fmt.Errorf("invalid tie-break %q (want one of %s)", tieBreak, strings.Join(tieBreaks, ", "))
+	}
+
+	var byDate func(a, b *journalEntry) int
+	generatedFirst := true
+	switch order {
+	case "date":
+		byDate = func(a, b *journalEntry) int { return a.Date.Compare(b.Date) }
+	case "date-desc":
+		byDate = func(a, b *journalEntry) int { return b.Date.Compare(a.Date) }
+		generatedFirst = false
+	case "source":
+		return func(a, b *journalEntry) bool { return a.Seq < b.Seq }, nil
+	default:
+		return nil, fmt.Errorf("invalid sort order %q (want one of %s)", order, strings.Join(sortOrders, ", "))
+	}
+
+	return func(a, b *journalEntry) bool {
+		if c := byDate(a, b); c != 0 {
+			return c < 0
+		}
+		// Generated entries, such as the opening balances, stand at the
+		// start of their day in reading order whatever the tie-breaker
+		if (a.Seq < 0) != (b.Seq < 0) {
+			return (a.Seq < 0) == generatedFirst
+		}
+		if c := tie(a, b); c != 0 {
+			return c < 0
+		}
+		return a.Seq < b.Seq
+	}, nil
+}
+
+// entrySorter orders journal entries using a bounded amount of memory. Entries
+// are buffered until the buffer is full, then sorted and written to a
+// temporary file as a run; Drain merges the runs back together.
+type entrySorter struct {
+	less  func(a, b *journalEntry) bool
+	limit int
+	buf   []journalEntry
+	runs  []*os.File
+}
+
+func newEntrySorter(less func(a, b *journalEntry) bool, limit int) *entrySorter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &entrySorter{less: less, limit: limit}
+}
+
+// Add buffers an entry, spilling the buffer to disk when it is full.
+func (s *entrySorter) Add(e journalEntry) error {
+	s.buf = append(s.buf, e)
+	if len(s.buf) >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *entrySorter) sortBuffer() {
+	sort.SliceStable(s.buf, func(i, j int) bool { return s.less(&s.buf[i], &s.buf[j]) })
+}
+
+// spill writes the sorted buffer to a new run file.
+func (s *entrySorter) spill() error {
+	s.sortBuffer()
+
+	f, err := os.CreateTemp("", "ynab_to_ledger-*.run")
+	if err != nil {
+		return fmt.Errorf("error creating sort run: %w", err)
+	}
+	s.runs = append(s.runs, f)
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for i := range s.buf {
+		if err := enc.Encode(&s.buf[i]); err != nil {
+			return fmt.Errorf("error writing sort run: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing sort run: %w", err)
+	}
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Drain calls fn for every entry in sorted order.
+func (s *entrySorter) Drain(fn func(journalEntry) error) error {
+	if len(s.runs) == 0 {
+		s.sortBuffer()
+		for _, e := range s.buf {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	m := &runMerger{less: s.less}
+	for _, f := range s.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error reading sort run: %w", err)
+		}
+		r := &sortRun{dec: gob.NewDecoder(bufio.NewReader(f))}
+		ok, err := r.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			m.runs = append(m.runs, r)
+		}
+	}
+	heap.Init(m)
+
+	for m.Len() > 0 {
+		r := m.runs[0]
+		if err := fn(r.head); err != nil {
+			return err
+		}
+		ok, err := r.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(m, 0)
+		} else {
+			heap.Pop(m)
+		}
+	}
+	return nil
+}
+
+// Close removes any temporary files created while sorting.
+func (s *entrySorter) Close() error {
+	var firstErr error
+	for _, f := range s.runs {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.runs = nil
+	s.buf = nil
+	return firstErr
+}
+
+// sortRun is a spilled run being read back during the merge.
+type sortRun struct {
+	dec  *gob.Decoder
+	head journalEntry
+}
+
+func (r *sortRun) advance() (bool, error) {
+	r.head = journalEntry{}
+	if err := r.dec.Decode(&r.head); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, fmt.Errorf("error reading sort run: %w", err)
+	}
+	return true, nil
+}
+
+// runMerger is a min-heap of runs keyed on their current head entry.
+type runMerger struct {
+	less func(a, b *journalEntry) bool
+	runs []*sortRun
+}
+
+func (m *runMerger) Len() int           { return len(m.runs) }
+func (m *runMerger) Less(i, j int) bool { return m.less(&m.runs[i].head, &m.runs[j].head) }
+func (m *runMerger) Swap(i, j int)      { m.runs[i], m.runs[j] = m.runs[j], m.runs[i] }
+func (m *runMerger) Push(x any)         { m.runs = append(m.runs, x.(*sortRun)) }
+func (m *runMerger) Pop() any {
+	old := m.runs
+	r := old[len(old)-1]
+	m.runs = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEntrySorterSpills(t *testing.T) {
+	less := func(a, b *journalEntry) bool { return a.Seq > b.Seq }
+
+	for _, limit := range []int{1, 3, 100} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			s := newEntrySorter(less, limit)
+			defer s.Close()
+
+			for i := 0; i < 10; i++ {
+				if err := s.Add(journalEntry{Seq: i, Text: fmt.Sprint(i)}); err != nil {
+					t.Fatalf("Add() error = %v", err)
+				}
+			}
+
+			var got []string
+			err := s.Drain(func(e journalEntry) error {
+				got = append(got, e.Text)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Drain() error = %v", err)
+			}
+
+			want := "9 8 7 6 5 4 3 2 1 0"
+			if strings.Join(got, " ") != want {
+				t.Errorf("Drain() order = %v, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestProcessSpilledMatchesInMemory(t *testing.T) {
+	mapping := &Mapping{
+		Accounts:   plainValues(map[string]string{"Checking": "Assets:Checking"}),
+		Categories: plainValues(map[string]string{"*": "Expenses:Misc"}),
+	}
+	csv, err := io.ReadAll(syntheticRegister(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := process(strings.NewReader(string(csv)), mapping)
+	if err != nil {
+		t.Fatalf("process() error = %v", err)
+	}
+
+	defer func(n int) { sortBufferSize = n }(sortBufferSize)
+	sortBufferSize = 7
+
+	got, err := process(strings.NewReader(string(csv)), mapping)
+	if err != nil {
+		t.Fatalf("process() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("spilled output differs from in-memory output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// syntheticRegister streams a register export with n rows without holding it
+// in memory.
+func syntheticRegister(n int) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		fmt.Fprintln(pw, `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"`)
+		for i := 0; i < n; i++ {
+			day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, i%3650)
+			fmt.Fprintf(pw, `"Checking","","%s","Payee %d","Bills: Item %d","Bills","Item %d","memo %d",$%d.%02d,$0.00,"Cleared"`+"\n",
+				day.Format("01/02/2006"), i%97, i%13, i%13, i, i%500+1, i%100)
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// BenchmarkConvert reports the peak heap in use while converting exports of
+// increasing size; it should stay roughly flat once the sort buffer spills.
+func BenchmarkConvert(b *testing.B) {
+	mapping := &Mapping{
+		Accounts:   plainValues(map[string]string{"Checking": "Assets:Checking"}),
+		Categories: plainValues(map[string]string{"*": "Expenses:Misc"}),
+	}
+	defer func(n int) { sortBufferSize = n }(sortBufferSize)
+	sortBufferSize = 5000
+
+	for _, rows := range []int{10000, 50000, 200000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			var peak atomic.Uint64
+			done := make(chan struct{})
+			go func() {
+				var ms runtime.MemStats
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(5 * time.Millisecond):
+						runtime.ReadMemStats(&ms)
+						if ms.HeapInuse > peak.Load() {
+							peak.Store(ms.HeapInuse)
+						}
+					}
+				}
+			}()
+
+			for i := 0; i < b.N; i++ {
+				if err := convert(syntheticRegister(rows), io.Discard, mapping, defaultConvertOptions()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			close(done)
+			b.ReportMetric(float64(peak.Load())/(1<<20), "peak-heap-MB")
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// periodWriter writes one journal file per year or month next to a master
+// file that includes them all. With closeYears set, every year boundary gets
+// closing entries at the end of the old file and an opening entry carrying
+// the balances forward at the start of the new one.
+type periodWriter struct {
+	master *journalStream
+	path   string // path of the master file
+	by     string // year or month
+
+	closeYears bool
+	retained   string // account Income and Expenses are closed into
+	equity     string // account balances are carried forward through
+
+	cur       *journalStream
+	curPeriod string
+	curYear   int
+	written   map[string]bool
+
+	balances  map[string]int64
+	commodity string
+}
+
+func newPeriodWriter(path string, opts convertOptions) (*periodWriter, error) {
+	if opts.SplitBy != "year" && opts.SplitBy != "month" {
+		return nil, fmt.Errorf("invalid --split-by %q (want year or month)", opts.SplitBy)
+	}
+	// Each period file is written in one go, so periods must not interleave
+	if opts.Sort == "source" {
+		return nil, fmt.Errorf("--split-by needs --sort date or date-desc")
+	}
+	if opts.CloseYears && opts.Sort != "date" {
+		return nil, fmt.Errorf("--close-years needs --sort date")
+	}
+
+	master, err := createJournalFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &periodWriter{
+		master:     master,
+		path:       path,
+		by:         opts.SplitBy,
+		closeYears: opts.CloseYears,
+		retained:   opts.RetainedEarnings,
+		equity:     opts.OpeningAccount,
+		written:    make(map[string]bool),
+		balances:   make(map[string]int64),
+	}, nil
+}
+
+// periodPath returns the file for a period, e.g. ynab_ledger-2021.dat for
+// the master file ynab_ledger.dat.
+func periodPath(master, period string) string {
+	ext := filepath.Ext(master)
+	return strings.TrimSuffix(master, ext) + "-" + period + ext
+}
+
+func (p *periodWriter) period(date time.Time) string {
+	if p.by == "month" {
+		return date.Format("2006-01")
+	}
+	return date.Format("2006")
+}
+
+// WriteDirective writes to the master file, ahead of its includes.
+func (p *periodWriter) WriteDirective(line string) error {
+	return p.master.WriteLine(line)
+}
+
+func (p *periodWriter) WriteEntry(e journalEntry) error {
+	if period := p.period(e.Date); period != p.curPeriod {
+		if err := p.startPeriod(period, e.Date); err != nil {
+			return err
+		}
+	}
+
+	if p.commodity == "" {
+		p.commodity = e.Commodity
+	}
+	for _, posting := range e.Postings {
+		p.balances[posting.Account] += posting.Amount
+	}
+	return p.cur.WriteEntry(e)
+}
+
+// startPeriod closes the current period file and opens the next one.
+func (p *periodWriter) startPeriod(period string, date time.Time) error {
+	if p.written[period] {
+		return fmt.Errorf("entries for %s are not contiguous", period)
+	}
+	p.written[period] = true
+
+	newYear := p.cur != nil && date.Year() != p.curYear
+	var carried []entryPosting
+	if p.cur != nil {
+		if p.closeYears && newYear {
+			var err error
+			if carried, err = p.closeYear(); err != nil {
+				return err
+			}
+		}
+		if err := p.cur.Close(); err != nil {
+			return err
+		}
+	}
+
+	file := periodPath(p.path, period)
+	cur, err := createJournalFile(file)
+	if err != nil {
+		return err
+	}
+	p.cur, p.curPeriod, p.curYear = cur, period, date.Year()
+	if err := p.master.WriteLine("include " + filepath.Base(file)); err != nil {
+		return err
+	}
+
+	if len(carried) > 0 {
+		jan1 := time.Date(date.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+		return p.cur.WriteEntry(renderEntry(jan1, "Opening Balances", carried, p.equity, p.commodity))
+	}
+	return nil
+}
+
+// closeYear writes the year-end entries to the current file: Income and
+// Expenses are zeroed into retained earnings, then every remaining balance is
+// moved to the equity account. It returns the balances to reopen, so that the
+// closing and opening entries cancel out when all files are read together.
+func (p *periodWriter) closeYear() ([]entryPosting, error) {
+	dec31 := time.Date(p.curYear, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+	nominal := sortedPostings(p.balances, isNominalAccount)
+	if len(nominal) > 0 {
+		for i := range nominal {
+			nominal[i].Amount = -nominal[i].Amount
+		}
+		e := renderEntry(dec31, "Closing Income and Expenses", nominal, p.retained, p.commodity)
+		if err := p.cur.WriteEntry(e); err != nil {
+			return nil, err
+		}
+		for _, posting := range e.Postings {
+			p.balances[posting.Account] += posting.Amount
+		}
+	}
+
+	carried := sortedPostings(p.balances, func(acct string) bool { return acct != p.equity })
+	if len(carried) == 0 {
+		return nil, nil
+	}
+	closing := make([]entryPosting, len(carried))
+	for i, posting := range carried {
+		closing[i] = entryPosting{Account: posting.Account, Amount: -posting.Amount}
+	}
+	if err := p.cur.WriteEntry(renderEntry(dec31, "Closing Balances", closing, p.equity, p.commodity)); err != nil {
+		return nil, err
+	}
+	return carried, nil
+}
+
+func (p *periodWriter) Close() error {
+	var err error
+	if p.cur != nil {
+		err = p.cur.Close()
+	}
+	if merr := p.master.Close(); err == nil {
+		err = merr
+	}
+	return err
+}
+
+// isNominalAccount reports whether an account is an Income or Expenses
+// account, which is reset to zero at the end of each year.
+func isNominalAccount(account string) bool {
+	top, _, _ := strings.Cut(account, ":")
+	return top == "Income" || top == "Expenses"
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPeriodWriterCloseYears(t *testing.T) {
+	testMapping := &Mapping{
+		Accounts: plainValues(map[string]string{"Checking": "Assets:Checking"}),
+		Categories: plainValues(map[string]string{
+			"Inflow: Ready to Assign": "Income:Salary",
+			"*":                       "Expenses:Misc",
+		}),
+	}
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/05/2021","Grocer","Food: Groceries","Food","Groceries","",$20.00,$0.00,"Cleared"
+"Checking","","12/20/2020","Grocer","Food: Groceries","Food","Groceries","",$30.00,$0.00,"Cleared"
+"Checking","","12/01/2020","Employer","Inflow: Ready to Assign","Inflow","Ready to Assign","",$0.00,$100.00,"Cleared"`
+
+	dir := t.TempDir()
+	master := filepath.Join(dir, "journal.ledger")
+
+	opts := defaultConvertOptions()
+	opts.SplitBy = "year"
+	opts.CloseYears = true
+	out, err := newPeriodWriter(master, opts)
+	if err != nil {
+		t.Fatalf("newPeriodWriter() error = %v", err)
+	}
+	if _, err := convertTo(strings.NewReader(csv), out, testMapping, opts); err != nil {
+		t.Fatalf("convertTo() error = %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	expected := map[string]string{
+		"journal.ledger": "include journal-2020.ledger\ninclude journal-2021.ledger\n",
+		"journal-2020.ledger": "2020/12/01 Employer\n    Income:Salary  \n    Assets:Checking  $100.00\n" +
+			"2020/12/20 Grocer\n    Expenses:Misc  $30.00\n    Assets:Checking  \n" +
+			"2020/12/31 Closing Income and Expenses\n    Expenses:Misc  $-30.00\n    Income:Salary  $100.00\n    Equity:Retained Earnings\n" +
+			"2020/12/31 Closing Balances\n    Assets:Checking  $-70.00\n    Equity:Retained Earnings  $70.00\n    Equity:Opening Balances",
+		"journal-2021.ledger": "2021/01/01 Opening Balances\n    Assets:Checking  $70.00\n    Equity:Retained Earnings  $-70.00\n    Equity:Opening Balances\n" +
+			"2021/01/05 Grocer\n    Expenses:Misc  $20.00\n    Assets:Checking  ",
+	}
+	for name, want := range expected {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mappingProblem is one finding of validateMapping.
+type mappingProblem struct {
+	Line    int
+	Warning bool
+	Message string
+}
+
+func (p mappingProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%d: %s: %s", p.Line, level, p.Message)
+}
+
+// ledgerTopLevel lists the account types Ledger reports group accounts by.
+var ledgerTopLevel = []string{"Assets", "Liabilities", "Equity", "Income", "Expenses"}
+
+// Known keys of each kind of object in a mapping file.
+var (
+	mappingKeys      = []string{"$schema", "accounts", "categories", "rules", "payees", "exclude"}
+	mappingEntryKeys = []string{"account", "when", "from", "until", "aliases", "tags", "metadata", "payee", "commodity", "ignore"}
+	mappingWhenKeys  = []string{"account", "payee"}
+	ruleKeys         = []string{"category", "account", "payee", "memo", "apply", "target", "from", "until"}
+	payeeRuleKeys    = []string{"match", "category", "name", "target", "from", "until"}
+	excludeRuleKeys  = []string{"category", "account", "payee", "memo", "from", "until"}
+)
+
+// validateMappingFile checks a mapping file, and the entries it never uses
+// when a register export is given, and prints what it finds. It fails when
+// there is any error; warnings alone are reported but accepted.
+func validateMappingFile(path, registerFile string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var register io.Reader
+	if registerFile != "" {
+		f, err := os.Open(registerFile)
+		if err != nil {
+			return fmt.Errorf("error opening file: %w", err)
+		}
+		defer f.Close()
+		register = f
+	}
+
+	var problems []mappingProblem
+	if mappingFormat(path) == "ledger" {
+		problems, err = validateLedgerMapping(data, register)
+	} else {
+		var doc *yaml.Node
+		if doc, err = parseMappingDocument(path, data); err == nil {
+			problems, err = validateMappingDocument(doc, register)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	errors := 0
+	for _, p := range problems {
+		fmt.Printf("%s:%s\n", path, p)
+		if !p.Warning {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("%s has %d errors", path, errors)
+	}
+	fmt.Printf("%s is valid (%d warnings)\n", path, len(problems))
+	return nil
+}
+
+// validateMapping checks the keys, targets and, when register is not nil,
+// the usage of the entries of a mapping file. It returns an error when the
+// file does not load at all, and the problems found ordered by line
+// otherwise.
+func validateMapping(data []byte, register io.Reader) ([]mappingProblem, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return validateMappingDocument(&doc, register)
+}
+
+// validateMappingDocument is validateMapping for a mapping file already
+// parsed, in any of the formats that parse into YAML nodes.
+func validateMappingDocument(doc *yaml.Node, register io.Reader) ([]mappingProblem, error) {
+	m, err := decodeMapping(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []mappingProblem
+	if len(doc.Content) > 0 {
+		problems = append(problems, checkMappingKeys(doc.Content[0])...)
+	}
+	return checkMapping(m, problems, register)
+}
+
+// validateLedgerMapping is validateMapping for the account declarations of a
+// Ledger file. Its lines are those of the notes.
+func validateLedgerMapping(data []byte, register io.Reader) ([]mappingProblem, error) {
+	m, err := parseLedgerMapping(data)
+	if err != nil {
+		return nil, err
+	}
+	return checkMapping(m, nil, register)
+}
+
+// checkMapping adds the problems with the targets and usage of a loaded
+// mapping to those already found, and sorts them.
+func checkMapping(m *Mapping, problems []mappingProblem, register io.Reader) ([]mappingProblem, error) {
+	problems = append(problems, checkTargets(m)...)
+	if register != nil {
+		unused, err := unusedEntries(m, register)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, unused...)
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Message < problems[j].Message
+	})
+	return problems, nil
+}
+
+// checkMappingKeys reports keys the mapping file format does not know, which
+// the YAML decoder silently ignores.
+func checkMappingKeys(root *yaml.Node) []mappingProblem {
+	var problems []mappingProblem
+	unknown := func(node *yaml.Node, known []string, where string) map[string]*yaml.Node {
+		values := make(map[string]*yaml.Node)
+		if node.Kind != yaml.MappingNode {
+			return values
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if !slices.Contains(known, key.Value) {
+				problems = append(problems, mappingProblem{Line: key.Line, Message: fmt.Sprintf("unknown key %q in %s", key.Value, where)})
+			}
+			values[key.Value] = node.Content[i+1]
+		}
+		return values
+	}
+	entry := func(node *yaml.Node) {
+		if when, ok := unknown(node, mappingEntryKeys, "mapping entry")["when"]; ok {
+			unknown(when, mappingWhenKeys, "when")
+		}
+	}
+
+	top := unknown(root, mappingKeys, "mapping file")
+	for _, section := range []string{"accounts", "categories"} {
+		node, ok := top[section]
+		if !ok || node.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			value := node.Content[i]
+			if value.Kind != yaml.SequenceNode {
+				entry(value)
+				continue
+			}
+			for _, item := range value.Content {
+				entry(item)
+			}
+		}
+	}
+	for section, known := range map[string][]string{"rules": ruleKeys, "payees": payeeRuleKeys, "exclude": excludeRuleKeys} {
+		if node, ok := top[section]; ok && node.Kind == yaml.SequenceNode {
+			for _, item := range node.Content {
+				unknown(item, known, section)
+			}
+		}
+	}
+	return problems
+}
+
+// mappingTarget is a Ledger account named by a mapping entry or rule.
+type mappingTarget struct {
+	Account string
+	Line    int
+}
+
+// targets lists every account the mapping can produce. Capture references
+// and the trailing "*" of group targets are kept as written.
+func (m *Mapping) targets() []mappingTarget {
+	var targets []mappingTarget
+	for _, section := range []map[string]MappingValue{m.Accounts, m.Categories} {
+		for _, value := range section {
+			for _, e := range value {
+				if e.Account != "" {
+					targets = append(targets, mappingTarget{e.Account, e.Line})
+				}
+			}
+		}
+	}
+	for _, r := range m.Rules {
+		targets = append(targets, mappingTarget{r.Target, r.Line})
+	}
+	for _, p := range m.Payees {
+		if p.Target != "" {
+			targets = append(targets, mappingTarget{p.Target, p.Line})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Line < targets[j].Line })
+	return targets
+}
+
+// checkTargets reports target accounts that Ledger would misread, that use
+// an unusual top-level account, or whose names clash with another target's
+// but for case.
+func checkTargets(m *Mapping) []mappingProblem {
+	var problems []mappingProblem
+	spellings := make(map[string]map[string]int) // lower-case prefix -> spelling -> first line
+
+	for _, t := range m.targets() {
+		// Capture references and group wildcards expand to names that
+		// cannot be checked here
+		account := captureRefRe.ReplaceAllString(t.Account, "X")
+		if strings.HasSuffix(account, ":*") {
+			account = strings.TrimSuffix(account, "*") + "X"
+		}
+
+		if err := checkAccountName(account); err != nil {
+			problems = append(problems, mappingProblem{Line: t.Line, Message: fmt.Sprintf("target %q: %v", t.Account, err)})
+			continue
+		}
+		top, _, _ := strings.Cut(account, ":")
+		if !slices.Contains(ledgerTopLevel, top) {
+			problems = append(problems, mappingProblem{Line: t.Line, Warning: true, Message: fmt.Sprintf("target %q is not under %s", t.Account, strings.Join(ledgerTopLevel, ", "))})
+		}
+
+		parts := strings.Split(account, ":")
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], ":")
+			lower := strings.ToLower(prefix)
+			if spellings[lower] == nil {
+				spellings[lower] = make(map[string]int)
+			}
+			if _, ok := spellings[lower][prefix]; !ok {
+				spellings[lower][prefix] = t.Line
+			}
+		}
+	}
+
+	// Report each clash once, at the shortest prefix where it appears
+	for lower, names := range spellings {
+		if len(names) < 2 {
+			continue
+		}
+		if i := strings.LastIndex(lower, ":"); i >= 0 && len(spellings[lower[:i]]) > 1 {
+			continue
+		}
+		var list []string
+		line := 0
+		for name, l := range names {
+			list = append(list, fmt.Sprintf("%q (line %d)", name, l))
+			if line == 0 || l < line {
+				line = l
+			}
+		}
+		sort.Strings(list)
+		problems = append(problems, mappingProblem{Line: line, Warning: true, Message: "accounts differ only in case: " + strings.Join(list, ", ")})
+	}
+	return problems
+}
+
+// checkAccountName reports why Ledger would not read a name as the account
+// intended, or nil.
+func checkAccountName(account string) error {
+	if strings.ContainsAny(account, "\t\n") || strings.Contains(account, "  ") {
+		return fmt.Errorf("tabs and double spaces end an account name in Ledger")
+	}
+	if i := strings.IndexAny(account, ";()[]{}@\""); i >= 0 {
+		return fmt.Errorf("invalid character %q", account[i])
+	}
+	for _, part := range strings.Split(account, ":") {
+		if part == "" {
+			return fmt.Errorf("empty account name segment")
+		}
+		if strings.TrimSpace(part) != part {
+			return fmt.Errorf("segment %q has a leading or trailing space", part)
+		}
+	}
+	return nil
+}
+
+// unusedEntries maps every row of a register export and reports the entries
+// and rules that none of them used. Catch-alls are not reported, and group
+// keys only when no category of their group is in the export.
+func unusedEntries(m *Mapping, register io.Reader) ([]mappingProblem, error) {
+	rows, err := newRegisterReader(register)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[mappingRef]bool)
+	groups := make(map[string]bool) // category groups in the export
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+
+		if group, _, ok := splitCategory(row.Category); ok {
+			groups[group] = true
+		}
+		if match, ok := m.excluded(row); ok {
+			used[match.Ref] = true
+			continue
+		}
+		if match, ok := m.matchPayeeName(row); ok {
+			used[match.Ref] = true
+		}
+		used[resolveAccount(m, row).Ref] = true
+		if other, ok := transferAccount(row.Payee); ok {
+			used[resolveAccount(m, row.withAccount(other)).Ref] = true
+		} else {
+			used[resolveCategory(m, row).Ref] = true
+		}
+	}
+
+	var problems []mappingProblem
+	report := func(ref mappingRef, line int, what string) {
+		if !used[ref] {
+			problems = append(problems, mappingProblem{Line: line, Warning: true, Message: what + " never matches a row of the export"})
+		}
+	}
+	for name, section := range map[string]map[string]MappingValue{"accounts": m.Accounts, "categories": m.Categories} {
+		for key, value := range section {
+			// Catch-alls and group keys are fallbacks, which a complete
+			// mapping leaves unused; a group key is only reported when
+			// the export has no category in its group
+			if key == "*" {
+				continue
+			}
+			if group, category, ok := splitCategory(key); name == "categories" && (!ok || category == "*") {
+				if !ok {
+					group = key
+				}
+				if groups[group] {
+					continue
+				}
+			}
+			for i, e := range value {
+				what := fmt.Sprintf("%s[%q]", name, key)
+				if len(value) > 1 {
+					what += fmt.Sprintf(" entry %d", i+1)
+				}
+				report(mappingRef{name, key, i}, e.Line, what)
+			}
+		}
+	}
+	for i, r := range m.Rules {
+		report(mappingRef{Section: "rules", Index: i}, r.Line, fmt.Sprintf("rules[%d]", i+1))
+	}
+	for i, p := range m.Payees {
+		report(mappingRef{Section: "payees", Index: i}, p.Line, fmt.Sprintf("payees[%d]", i+1))
+	}
+	for i, r := range m.Exclude {
+		report(mappingRef{Section: "exclude", Index: i}, r.Line, fmt.Sprintf("exclude[%d]", i+1))
+	}
+	return problems, nil
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidateMapping(t *testing.T) {
+	data := []byte(`accounts:
+  "Checking": Assets:Checking
+  "Savings": assets:Savings
+  "Visa":
+    account: Liabilities:Visa
+    tagz: [x]
+categories:
+  "Food: Groceries": "Expenses: Food"
+  "Bills: Electric": Expenses:Bills  Electric
+  "Fun": Fun:Stuff
+rules:
+  - category: "/^Bills: (.*)$/"
+    target: Expenses:Bills:$1
+    taget: x
+`)
+	csv := `"Account","Flag","Date","Payee","Category Group/Category","Category Group","Category","Memo","Outflow","Inflow","Cleared"
+"Checking","","01/02/2021","Grocer","Food: Groceries","Food","Groceries","",$5.00,$0.00,"Cleared"
+"Visa","","01/03/2021","Power Co","Bills: Water","Bills","Water","",$50.00,$0.00,"Cleared"`
+
+	problems, err := validateMapping(data, strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("validateMapping() error = %v", err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	expected := []string{
+		`2: warning: accounts differ only in case: "Assets" (line 2), "assets" (line 3)`,
+		`3: warning: accounts["Savings"] never matches a row of the export`,
+		`3: warning: target "assets:Savings" is not under Assets, Liabilities, Equity, Income, Expenses`,
+		`6: error: unknown key "tagz" in mapping entry`,
+		`8: error: target "Expenses: Food": segment " Food" has a leading or trailing space`,
+		`9: warning: categories["Bills: Electric"] never matches a row of the export`,
+		`9: error: target "Expenses:Bills  Electric": tabs and double spaces end an account name in Ledger`,
+		`10: warning: categories["Fun"] never matches a row of the export`,
+		`10: warning: target "Fun:Stuff" is not under Assets, Liabilities, Equity, Income, Expenses`,
+		`14: error: unknown key "taget" in rules`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("validateMapping() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Entries written on one line are still told apart
+	problems, err = validateMapping([]byte(`{accounts: {"Checking": Assets:Checking, "Savings": Assets:Savings}, rules: [{payee: Grocer, target: Expenses:Food}, {payee: Cafe, target: Expenses:Fun}]}`), strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("validateMapping() error = %v", err)
+	}
+	got = got[:0]
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	expected = []string{
+		`1: warning: accounts["Savings"] never matches a row of the export`,
+		`1: warning: rules[2] never matches a row of the export`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("validateMapping() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Fallbacks that a complete mapping leaves unused are not reported
+	problems, err = validateMapping([]byte(`accounts:
+  "Checking": Assets:Checking
+  "Visa": Liabilities:Visa
+  "*": Assets:Unknown
+categories:
+  "Food: Groceries": Expenses:Food
+  "Bills: Water": Expenses:Bills:Water
+  "Bills: *": Expenses:Bills
+  "Food": Expenses:Food
+  "Travel": Expenses:Travel
+  "Fun: *": Expenses:Fun
+  "*": Expenses:Unknown
+`), strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("validateMapping() error = %v", err)
+	}
+	got = got[:0]
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	expected = []string{
+		`10: warning: categories["Travel"] never matches a row of the export`,
+		`11: warning: categories["Fun: *"] never matches a row of the export`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("validateMapping() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if _, err := validateMapping([]byte("rules:\n  - category: x\n"), nil); err == nil {
+		t.Error("validateMapping() should fail on a mapping that does not load")
+	}
+}
+
+// TestMappingSchemaKeys keeps the JSON Schema in step with the keys
+// validate-mapping knows.
+func TestMappingSchemaKeys(t *testing.T) {
+	type object struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+		OneOf      []object                   `json:"oneOf"`
+	}
+	var schema struct {
+		object
+		Defs map[string]object `json:"$defs"`
+	}
+	if err := json.Unmarshal(mappingSchema, &schema); err != nil {
+		t.Fatalf("schema is not valid JSON: %v", err)
+	}
+	var when object
+	if err := json.Unmarshal(schema.Defs["entry"].OneOf[1].Properties["when"], &when); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		props map[string]json.RawMessage
+		known []string
+	}{
+		{"mapping file", schema.Properties, mappingKeys},
+		{"entry", schema.Defs["entry"].OneOf[1].Properties, mappingEntryKeys},
+		{"when", when.Properties, mappingWhenKeys},
+		{"rule", schema.Defs["rule"].Properties, ruleKeys},
+		{"payee rule", schema.Defs["payeeRule"].Properties, payeeRuleKeys},
+		{"exclude rule", schema.Defs["excludeRule"].Properties, excludeRuleKeys},
+	} {
+		got := sortedKeys(tt.props)
+		want := slices.Clone(tt.known)
+		sort.Strings(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("schema %s keys = %v, want %v", tt.name, got, want)
+		}
+	}
+}
@@ -1,9 +1,17 @@
 module github.com/jaredtconnor/ynab_to_ledger
 
-go 1.21
+go 1.21.0
 
 require github.com/spf13/cobra v1.9.1
 
+require (
+	github.com/pelletier/go-toml/v2 v2.2.4
+	golang.org/x/term v0.15.0
+	golang.org/x/text v0.14.0
+)
+
+require golang.org/x/sys v0.15.0 // indirect
+
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect